@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -10,11 +12,11 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/alexandr-lakeev/otus-final-project/internal/app/usecase"
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
 	"github.com/alexandr-lakeev/otus-final-project/internal/config"
 	internalcache "github.com/alexandr-lakeev/otus-final-project/internal/infrastructure/cache"
-	internalimage "github.com/alexandr-lakeev/otus-final-project/internal/infrastructure/image"
 	internalloger "github.com/alexandr-lakeev/otus-final-project/internal/infrastructure/logger"
+	internalpreviewer "github.com/alexandr-lakeev/otus-final-project/internal/infrastructure/previewer"
 	internalhttp "github.com/alexandr-lakeev/otus-final-project/internal/infrastructure/server/http"
 )
 
@@ -25,6 +27,13 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		if err := sign(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	flag.Parse()
 
 	config, err := config.NewConfig(configFile)
@@ -32,31 +41,53 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if len(config.Server.Signature.Keys) == 0 && !config.Server.Signature.Unsafe {
+		log.Fatal("signature keys are required unless the unsafe mode is on")
+	}
+
 	logger, err := internalloger.New(config.Logger)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	cache := internalcache.NewCache(config.Previewer.CacheSize, config.Previewer.CacheDir)
+	diskCache, err := internalcache.NewCache(
+		config.Previewer.CacheSize,
+		config.Previewer.CacheMaxBytes,
+		config.Previewer.CacheDir,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var cache interface {
+		app.Cache
+		io.Closer
+	} = diskCache
 
-	httpClient := &http.Client{
-		Timeout: config.Previewer.RequestTimeout,
+	if config.Previewer.MemoryCacheMaxBytes > 0 {
+		cache = internalcache.NewTieredCache(config.Previewer.MemoryCacheMaxBytes, diskCache)
 	}
 
-	uc := usecase.New(
-		internalimage.NewLoader(httpClient),
-		internalimage.NewResizer(),
-		cache,
-		logger,
-	)
+	uc, err := internalpreviewer.NewProfileRouter(config.Previewer, cache, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the requests still running when the graceful shutdown times out are cancelled
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
 
-	server := internalhttp.NewServer(config.Server, uc, logger)
+	server := internalhttp.NewServer(requestsCtx, config.Server, uc, logger)
 
 	ctx, cancel := signal.NotifyContext(context.Background(),
 		syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	defer cancel()
 
+	stopped := make(chan struct{})
+
 	go func() {
+		defer close(stopped)
+
 		<-ctx.Done()
 
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
@@ -65,13 +96,20 @@ func main() {
 		if err := server.Shutdown(ctx); err != nil {
 			logger.Error("failed to stop http server: " + err.Error())
 		}
+		cancelRequests()
+
+		if err := cache.Close(); err != nil {
+			logger.Error("failed to close cache: " + err.Error())
+		}
 	}()
 
 	logger.Info("previewer is running...")
 
-	if err := server.ListenAndServe(); err != nil {
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		logger.Error("failed to start http server: " + err.Error())
 		cancel()
 		os.Exit(1)
 	}
+
+	<-stopped
 }
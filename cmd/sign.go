@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/config"
+	"github.com/alexandr-lakeev/otus-final-project/pkg/signature"
+)
+
+var errNoSignatureKey = errors.New("no signature key: pass -key or set server.signature.keys in the config")
+
+// sign prints the signed paths, e.g. previewer sign -key secret /fill/300/200/example.com/img.jpg
+func sign(args []string) error {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	flags.StringVar(&configFile, "config", configFile, "Path to configuration file, its first signature key is used")
+	key := flags.String("key", "", "Signature key")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: previewer sign [-key key | -config file] path...")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *key == "" {
+		cfg, err := config.NewConfig(configFile)
+		if err != nil {
+			return err
+		}
+
+		if len(cfg.Server.Signature.Keys) == 0 {
+			return errNoSignatureKey
+		}
+		*key = cfg.Server.Signature.Keys[0]
+	}
+
+	for _, path := range flags.Args() {
+		signed, err := signature.SignPath([]byte(*key), path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		fmt.Fprintln(os.Stdout, signed)
+	}
+
+	return nil
+}
@@ -1,13 +1,24 @@
 package app
 
 import (
+	"context"
 	"errors"
-	"image"
 )
 
 var ErrNotFoundInCache = errors.New("not found in cache")
+var ErrTooLargeForCache = errors.New("too large for cache")
+
+// CacheStatus tells how the image has been obtained
+type CacheStatus string
+
+const (
+	CacheStatusHit         CacheStatus = "HIT"
+	CacheStatusMiss        CacheStatus = "MISS"
+	CacheStatusStale       CacheStatus = "STALE"
+	CacheStatusRevalidated CacheStatus = "REVALIDATED"
+)
 
 type Cache interface {
-	Get(url string, width, height int) (image.Image, error)
-	Set(url string, width, height int, img image.Image) error
+	Get(ctx context.Context, url string, variant Variant) (*EncodedImage, error)
+	Set(ctx context.Context, url string, variant Variant, img *EncodedImage) error
 }
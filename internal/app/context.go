@@ -2,4 +2,8 @@ package app
 
 type ContextKey string
 
-const RequestIDContextKey ContextKey = "request_id"
+const (
+	RequestIDContextKey ContextKey = "request_id"
+	// ClientIPContextKey keeps the address of the client for X-Forwarded-For
+	ClientIPContextKey ContextKey = "client_ip"
+)
@@ -2,81 +2,641 @@ package deliveryhttp
 
 import (
 	"context"
-	"image/jpeg"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image/color"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+	"github.com/alexandr-lakeev/otus-final-project/pkg/signature"
 	"github.com/pkg/errors"
 )
 
-const UrlPartsQuantityBeforeImgPath = 5
-const ImageQualityPercent = 100
+var (
+	ErrBadFillRequest = errors.New("bad fill request")
+	ErrBadSignature   = errors.New("bad signature")
+	ErrUnknownAlias   = errors.New("unknown origin alias")
+	ErrRawURLDisabled = errors.New("only origin aliases are allowed")
+	ErrUnauthorized   = errors.New("admin token required")
+)
+
+var DefaultBackground = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+
+var schemes = map[string]bool{
+	"http":  true,
+	"https": true,
+	"file":  true,
+	"s3":    true,
+}
+
+// aliasSchemes are served with the credentials of the previewer, the clients reach them through the aliases only
+var aliasSchemes = map[string]bool{
+	"file": true,
+	"s3":   true,
+}
+
+type errorStatus struct {
+	statusCode int
+	// code is the machine readable error of the response body
+	code string
+}
+
+// errorStatuses are checked in order, the first error found in the chain wins
+var errorStatuses = []struct {
+	err    error
+	status errorStatus
+}{
+	// nginx's status of the requests closed by the client, the response is not seen by anyone
+	{context.Canceled, errorStatus{499, "client_closed_request"}},
+	{ErrBadFillRequest, errorStatus{http.StatusBadRequest, "bad_request"}},
+	{ErrBadSignature, errorStatus{http.StatusForbidden, "bad_signature"}},
+	{ErrUnknownAlias, errorStatus{http.StatusBadRequest, "unknown_alias"}},
+	{ErrRawURLDisabled, errorStatus{http.StatusForbidden, "raw_url_disabled"}},
+	{ErrUnauthorized, errorStatus{http.StatusUnauthorized, "unauthorized"}},
+	{app.ErrUnsupportedScheme, errorStatus{http.StatusBadRequest, "unsupported_scheme"}},
+	{app.ErrUnsupportedFormat, errorStatus{http.StatusBadRequest, "unsupported_format"}},
+	{app.ErrInvalidDimensions, errorStatus{http.StatusBadRequest, "invalid_dimensions"}},
+	{app.ErrDimensionsNotAllowed, errorStatus{http.StatusBadRequest, "dimensions_not_allowed"}},
+	{app.ErrUnknownPreset, errorStatus{http.StatusBadRequest, "unknown_preset"}},
+	{app.ErrForbiddenHost, errorStatus{http.StatusForbidden, "forbidden_host"}},
+	{app.ErrImageNotFound, errorStatus{http.StatusNotFound, "image_not_found"}},
+	{app.ErrContentNotImage, errorStatus{http.StatusUnsupportedMediaType, "content_not_image"}},
+	{app.ErrCorruptImage, errorStatus{http.StatusUnprocessableEntity, "corrupt_image"}},
+	{app.ErrImageTooLarge, errorStatus{http.StatusRequestEntityTooLarge, "image_too_large"}},
+	{app.ErrImageDimensionsTooLarge, errorStatus{http.StatusUnprocessableEntity, "image_dimensions_too_large"}},
+	{app.ErrTimeout, errorStatus{http.StatusGatewayTimeout, "upstream_timeout"}},
+	{app.ErrOriginUnavailable, errorStatus{http.StatusServiceUnavailable, "origin_unavailable"}},
+	{app.ErrBadRequest, errorStatus{http.StatusBadGateway, "upstream_bad_request"}},
+	{app.ErrInternal, errorStatus{http.StatusBadGateway, "upstream_error"}},
+	{app.ErrUnknown, errorStatus{http.StatusBadGateway, "upstream_error"}},
+}
+
+// defaultErrorStatus is used for the errors of the origin connection and the unexpected ones
+var defaultErrorStatus = errorStatus{http.StatusBadGateway, "bad_gateway"}
+
+type errorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// optionParsers handle the {name}:{value} segments
+var optionParsers = map[string]func(request *fillRequest, value string) error{
+	"bg":     parseBackground,
+	"format": parseFormat,
+	"q":      parseQuality,
+	"preset": parsePreset,
+}
+
+var formatAliases = map[string]app.ImageFormat{
+	"jpg": app.ImageFormatJPEG,
+}
+
+// Options are the settings of the handler
+type Options struct {
+	// SignatureKeys verify the url signatures, the first one is used for signing
+	SignatureKeys []string
+	// Unsafe accepts the requests without a signature
+	Unsafe bool
+	// RawURLs allows the urls of arbitrary origins
+	RawURLs   bool
+	Aliases   []AliasOptions
+	HTTPCache HTTPCacheOptions
+	// AdminToken authorizes the administrative requests
+	AdminToken string
+}
+
+// AliasOptions describe the origin requested as /@{name}/{path}
+type AliasOptions struct {
+	Name    string
+	BaseURL string
+	// RewriteFrom is the prefix of the path replaced with RewriteTo, it ends at a path segment boundary
+	RewriteFrom string
+	RewriteTo   string
+	// Headers are sent to the origin as is
+	Headers map[string]string
+}
+
+// HTTPCacheOptions set the caching headers of the previews
+type HTTPCacheOptions struct {
+	// MaxAge of zero makes the clients revalidate every time
+	MaxAge time.Duration
+	// Directives are appended to Cache-Control
+	Directives string
+}
 
 type Handler struct {
-	useCase app.UseCase
-	logger  app.Logger
+	useCase  app.UseCase
+	logger   app.Logger
+	verifier *signature.Verifier
+	// unsafe accepts the requests without a signature
+	unsafe    bool
+	httpCache HTTPCacheOptions
+	aliases   map[string]originAlias
+	// rawURLs allows the urls of arbitrary origins
+	rawURLs    bool
+	adminToken string
+}
+
+// originAlias is the origin requested as /@{name}/{path}
+type originAlias struct {
+	baseURL string
+	rewrite bool
+	// rewriteFrom and rewriteTo have no trailing slash, so the prefix is matched up to a slash
+	rewriteFrom string
+	rewriteTo   string
+	headers     http.Header
+}
+
+// fillRequest is parsed from /{mode}/[{signature}/][{scheme}/][{name}:{value}/...]{width}/{height}/{url},
+// the preset:{name} option replaces the dimensions
+type fillRequest struct {
+	scheme  string
+	variant app.Variant
+	preset  string
+	url     string
 }
 
-func NewHandler(useCase app.UseCase, logger app.Logger) *Handler {
+func NewHandler(useCase app.UseCase, logger app.Logger, opts Options) *Handler {
+	keys := make([][]byte, 0, len(opts.SignatureKeys))
+	for _, key := range opts.SignatureKeys {
+		keys = append(keys, []byte(key))
+	}
+
+	aliases := make(map[string]originAlias, len(opts.Aliases))
+	for _, alias := range opts.Aliases {
+		headers := make(http.Header, len(alias.Headers))
+		for name, value := range alias.Headers {
+			headers.Set(name, value)
+		}
+
+		aliases[alias.Name] = originAlias{
+			baseURL:     strings.TrimSuffix(alias.BaseURL, "/"),
+			rewrite:     alias.RewriteFrom != "",
+			rewriteFrom: strings.TrimSuffix(alias.RewriteFrom, "/"),
+			rewriteTo:   strings.TrimSuffix(alias.RewriteTo, "/"),
+			headers:     headers,
+		}
+	}
+
 	return &Handler{
-		useCase: useCase,
-		logger:  logger,
+		useCase:    useCase,
+		logger:     logger,
+		verifier:   signature.NewVerifier(keys...),
+		unsafe:     opts.Unsafe,
+		httpCache:  opts.HTTPCache,
+		aliases:    aliases,
+		rawURLs:    opts.RawURLs,
+		adminToken: opts.AdminToken,
 	}
 }
 
-func (h *Handler) Fill(ctx context.Context) http.HandlerFunc {
+func (h *Handler) Fill() http.HandlerFunc {
+	return h.handle(app.ResizeModeFill)
+}
+
+func (h *Handler) Fit() http.HandlerFunc {
+	return h.handle(app.ResizeModeFit)
+}
+
+func (h *Handler) Pad() http.HandlerFunc {
+	return h.handle(app.ResizeModePad)
+}
+
+func (h *Handler) Resize() http.HandlerFunc {
+	return h.handle(app.ResizeModeResize)
+}
+
+// PurgeFailure makes the previewer forget the failed load of the image, the path is the one of its preview
+// without the signature. The signed urls are public, so the request is authorized by the admin token.
+func (h *Handler) PurgeFailure() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		parts := strings.SplitN(r.URL.Path, "/", UrlPartsQuantityBeforeImgPath)
+		if !h.isAdmin(r) {
+			h.writeError(w, r, ErrUnauthorized)
+			return
+		}
+
+		path := r.URL.Path
+		mode, _ := nextSegment(strings.TrimPrefix(path, "/"))
 
-		if len(parts) < UrlPartsQuantityBeforeImgPath {
-			w.WriteHeader(http.StatusBadRequest)
+		request, err := h.parseFillRequest(path, app.ResizeMode(mode))
+		if err != nil {
+			h.writeError(w, r, err)
 			return
 		}
 
-		width, err := strconv.Atoi(parts[2])
+		imgUrl, _, err := h.resolveOrigin(request)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			h.writeError(w, r, err)
 			return
 		}
 
-		height, err := strconv.Atoi(parts[3])
+		if err := h.useCase.PurgeFailure(r.Context(), imgUrl); err != nil {
+			h.writeError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *Handler) isAdmin(r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	if h.adminToken == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(h.adminToken)) == 1
+}
+
+// handle serves the request within its context, so the work stops when the client goes away
+func (h *Handler) handle(mode app.ResizeMode) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path, err := h.verifySignature(r.URL)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			h.writeError(w, r, err)
 			return
 		}
 
-		url := parts[4]
-		if url == "" {
-			w.WriteHeader(http.StatusBadRequest)
+		request, err := h.parseFillRequest(path, mode)
+		if err != nil {
+			h.writeError(w, r, err)
 			return
 		}
 
-		image, err := h.useCase.Fill(ctx, &app.FillCommand{
-			ImgUrl:  "//" + url, // to prevent error if target is ip address + port https://github.com/golang/go/issues/19297#issuecomment-282650053
-			Width:   width,
-			Height:  height,
-			Headers: r.Header,
+		imgUrl, originHeaders, err := h.resolveOrigin(request)
+		if err != nil {
+			h.writeError(w, r, err)
+			return
+		}
+
+		image, err := h.useCase.Fill(r.Context(), &app.FillCommand{
+			ImgUrl:        imgUrl,
+			Variant:       request.variant,
+			Preset:        request.preset,
+			Headers:       r.Header,
+			OriginHeaders: originHeaders,
 		})
 
+		if errors.Is(err, context.Canceled) {
+			h.logger.Info("fill cancelled: " + err.Error())
+			h.writeError(w, r, err)
+			return
+		}
+
 		if err != nil {
 			h.logger.Error(errors.Wrap(err, "fill error").Error())
-			w.WriteHeader(http.StatusBadGateway)
+			h.writeError(w, r, err)
 			return
 		}
 
-		w.Header().Set("Content-Type", "image/jpg")
+		if request.variant.Format == "" {
+			// the format is negotiated by the Accept header
+			w.Header().Set("Vary", "Accept")
+		}
+		if image.CacheStatus != "" {
+			w.Header().Set("X-Cache-Status", string(image.CacheStatus))
+		}
+		h.setCacheHeaders(w, image)
+
+		if isNotModified(r, image) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", image.ContentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(image.Data)))
 		w.WriteHeader(http.StatusOK)
 
-		err = jpeg.Encode(w, image, &jpeg.Options{
-			Quality: ImageQualityPercent,
-		})
+		if _, err := w.Write(image.Data); err != nil {
+			h.logger.Error(errors.Wrap(err, "response write error").Error())
+		}
+	}
+}
 
-		if err != nil {
-			h.logger.Error(errors.Wrap(err, "jpeg encode error").Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+func (h *Handler) setCacheHeaders(w http.ResponseWriter, image *app.EncodedImage) {
+	if image.ETag != "" {
+		w.Header().Set("ETag", image.ETag)
+	}
+	if !image.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", image.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if image.Origin.NoStore {
+		w.Header().Set("Cache-Control", "no-store")
+		return
+	}
+
+	// the preview is not fresher than its source, a stale one has to be revalidated
+	now := time.Now()
+	maxAge := h.httpCache.MaxAge
+	if !image.Origin.Expires.IsZero() {
+		if remaining := image.Origin.Expires.Sub(now); remaining < maxAge {
+			maxAge = remaining
 		}
 	}
+	maxAge = maxAge.Truncate(time.Second)
+
+	cacheControl := "no-cache"
+	if maxAge > 0 {
+		cacheControl = fmt.Sprintf("max-age=%d", int64(maxAge/time.Second))
+	} else {
+		maxAge = 0
+	}
+	if h.httpCache.Directives != "" {
+		cacheControl += ", " + h.httpCache.Directives
+	}
+
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("Expires", now.Add(maxAge).UTC().Format(http.TimeFormat))
+}
+
+// isNotModified checks the conditional headers, If-None-Match takes precedence over If-Modified-Since
+func isNotModified(r *http.Request, image *app.EncodedImage) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, image.ETag)
+	}
+
+	ifModifiedSince := r.Header.Get("If-Modified-Since")
+	if ifModifiedSince == "" || image.LastModified.IsZero() {
+		return false
+	}
+
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+
+	// the header has the precision of a second
+	return !image.LastModified.Truncate(time.Second).After(since)
+}
+
+// etagMatches uses the weak comparison required for If-None-Match
+func etagMatches(header, etag string) bool {
+	if etag == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeError responds with the status of the error and the JSON body, the details of the error are logged only
+func (h *Handler) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, message := h.resolveErrorStatus(err)
+
+	response := errorResponse{
+		Code:    status.code,
+		Message: message,
+	}
+	if requestID := r.Context().Value(app.RequestIDContextKey); requestID != nil {
+		response.RequestID = fmt.Sprint(requestID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status.statusCode)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		h.logger.Error(errors.Wrap(err, "response write error").Error())
+	}
+}
+
+func (h *Handler) resolveErrorStatus(err error) (errorStatus, string) {
+	for _, known := range errorStatuses {
+		if errors.Is(err, known.err) {
+			return known.status, known.err.Error()
+		}
+	}
+
+	return defaultErrorStatus, http.StatusText(defaultErrorStatus.statusCode)
+}
+
+// verifySignature checks the signature segment following the mode and returns the path without it.
+// The signature is calculated over the escaped path, as it has been sent by the client.
+func (h *Handler) verifySignature(u *url.URL) (string, error) {
+	mode, rest := nextSegment(strings.TrimPrefix(u.Path, "/"))
+	segment, unsigned := nextSegment(rest)
+
+	if h.unsafe {
+		// the signature is optional and is not checked
+		if segment == "unsafe" || signature.IsSignature(segment) {
+			return "/" + mode + "/" + unsigned, nil
+		}
+
+		return u.Path, nil
+	}
+
+	escapedMode, escapedRest := nextSegment(strings.TrimPrefix(u.EscapedPath(), "/"))
+	_, escapedUnsigned := nextSegment(escapedRest)
+
+	if !h.verifier.Verify(segment, escapedMode+"/"+escapedUnsigned) {
+		return "", ErrBadSignature
+	}
+
+	return "/" + mode + "/" + unsigned, nil
+}
+
+func (h *Handler) parseFillRequest(path string, mode app.ResizeMode) (*fillRequest, error) {
+	// skip the route prefix
+	_, rest := nextSegment(strings.TrimPrefix(path, "/"))
+
+	request := &fillRequest{
+		variant: app.Variant{Mode: mode},
+	}
+
+	if mode == app.ResizeModePad {
+		request.variant.Background = DefaultBackground
+	}
+
+	var err error
+
+	segment, tail := nextSegment(rest)
+	for {
+		if _, err := strconv.Atoi(segment); err == nil {
+			if request.preset != "" {
+				return nil, ErrBadFillRequest
+			}
+			break
+		}
+
+		// the url follows the options of the preset, its host may have a port looking like an option
+		if request.preset != "" && !schemes[segment] && !isOption(segment) {
+			break
+		}
+
+		switch {
+		case schemes[segment] && request.scheme == "":
+			request.scheme = segment
+		case strings.Contains(segment, ":"):
+			if err := parseOption(request, segment); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrBadFillRequest
+		}
+
+		rest = tail
+		segment, tail = nextSegment(rest)
+	}
+
+	if request.preset == "" {
+		segment, rest = nextSegment(rest)
+		if request.variant.Width, err = strconv.Atoi(segment); err != nil {
+			return nil, ErrBadFillRequest
+		}
+
+		segment, rest = nextSegment(rest)
+		if request.variant.Height, err = strconv.Atoi(segment); err != nil {
+			return nil, ErrBadFillRequest
+		}
+	}
+
+	request.url = rest
+	if request.url == "" {
+		return nil, ErrBadFillRequest
+	}
+
+	return request, nil
+}
+
+// resolveOrigin returns the url of the image and the headers of its origin
+func (h *Handler) resolveOrigin(request *fillRequest) (string, http.Header, error) {
+	if !strings.HasPrefix(request.url, "@") {
+		if !h.rawURLs || aliasSchemes[request.scheme] {
+			return "", nil, ErrRawURLDisabled
+		}
+
+		return h.buildImgUrl(request), nil, nil
+	}
+
+	// the scheme belongs to the base url of the alias
+	if request.scheme != "" {
+		return "", nil, ErrBadFillRequest
+	}
+
+	name, rest := nextSegment(strings.TrimPrefix(request.url, "@"))
+
+	alias, ok := h.aliases[name]
+	if !ok {
+		return "", nil, ErrUnknownAlias
+	}
+
+	// the path must stay under the base url
+	for _, segment := range strings.Split(rest, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", nil, ErrBadFillRequest
+		}
+	}
+
+	imgPath := "/" + rest
+	if alias.rewrite && strings.HasPrefix(imgPath, alias.rewriteFrom+"/") {
+		imgPath = alias.rewriteTo + strings.TrimPrefix(imgPath, alias.rewriteFrom)
+	}
+
+	return alias.baseURL + imgPath, alias.headers, nil
+}
+
+func (h *Handler) buildImgUrl(request *fillRequest) string {
+	// the url starts with // to prevent error if target is ip address + port https://github.com/golang/go/issues/19297#issuecomment-282650053
+	// the loader uses its default scheme if the scheme is not set
+	if request.scheme == "" {
+		return "//" + request.url
+	}
+
+	return request.scheme + "://" + request.url
+}
+
+func isOption(segment string) bool {
+	_, ok := optionParsers[strings.SplitN(segment, ":", 2)[0]]
+
+	return ok && strings.Contains(segment, ":")
+}
+
+func parseOption(request *fillRequest, segment string) error {
+	parts := strings.SplitN(segment, ":", 2)
+
+	parser, ok := optionParsers[parts[0]]
+	if !ok {
+		return ErrBadFillRequest
+	}
+
+	return parser(request, parts[1])
+}
+
+// parseBackground accepts RRGGBB and RRGGBBAA hex colors
+func parseBackground(request *fillRequest, value string) error {
+	if request.variant.Mode != app.ResizeModePad {
+		return ErrBadFillRequest
+	}
+
+	if len(value) == 6 {
+		value += "ff"
+	}
+
+	rgba, err := hex.DecodeString(value)
+	if err != nil || len(rgba) != 4 {
+		return ErrBadFillRequest
+	}
+
+	request.variant.Background = color.NRGBA{R: rgba[0], G: rgba[1], B: rgba[2], A: rgba[3]}
+
+	return nil
+}
+
+func parseFormat(request *fillRequest, value string) error {
+	format := app.ImageFormat(strings.ToLower(value))
+	if alias, ok := formatAliases[string(format)]; ok {
+		format = alias
+	}
+
+	if format == "" {
+		return ErrBadFillRequest
+	}
+
+	request.variant.Format = format
+
+	return nil
+}
+
+// parseQuality accepts 1-100, the encoder clamps it to the configured bounds
+func parseQuality(request *fillRequest, value string) error {
+	quality, err := strconv.Atoi(value)
+	if err != nil || quality < 1 || quality > 100 {
+		return ErrBadFillRequest
+	}
+
+	request.variant.Quality = quality
+
+	return nil
+}
+
+func parsePreset(request *fillRequest, value string) error {
+	if value == "" || request.preset != "" {
+		return ErrBadFillRequest
+	}
+
+	request.preset = value
+
+	return nil
+}
+
+func nextSegment(path string) (string, string) {
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
 }
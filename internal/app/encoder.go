@@ -0,0 +1,52 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"time"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+type ImageFormat string
+
+const (
+	ImageFormatJPEG ImageFormat = "jpeg"
+	ImageFormatPNG  ImageFormat = "png"
+	ImageFormatGIF  ImageFormat = "gif"
+	ImageFormatWebP ImageFormat = "webp"
+	ImageFormatAVIF ImageFormat = "avif"
+)
+
+// DefaultImageFormat is used when the client does not ask for a specific format
+const DefaultImageFormat = ImageFormatJPEG
+
+type EncodedImage struct {
+	Data        []byte
+	ContentType string
+	// ETag is the strong validator of the data
+	ETag         string
+	LastModified time.Time
+	// Origin is the caching metadata of the source image the data is made of
+	Origin Origin
+	// CacheStatus is set on the result of the use case, it is not stored
+	CacheStatus CacheStatus
+}
+
+// NewETag returns the quoted hash of the data
+func NewETag(data []byte) string {
+	sum := sha256.Sum256(data)
+
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+type ImageEncoder interface {
+	Encode(img image.Image, format ImageFormat, quality int) (*EncodedImage, error)
+	// ContentTypes returns the content types of the supported formats
+	ContentTypes() map[ImageFormat]string
+	// Quality resolves the requested quality of the format: zero means the default one,
+	// the result is 0 for the formats without quality
+	Quality(format ImageFormat, requested int) int
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"image"
 	"net/http"
+	"time"
 )
 
 var ErrImageNotFound = errors.New("image not found")
@@ -12,7 +13,58 @@ var ErrBadRequest = errors.New("bad request")
 var ErrInternal = errors.New("an internal error occurred while loading image")
 var ErrUnknown = errors.New("an unknown error occurred while loading image")
 var ErrContentNotImage = errors.New("content not an image")
+var ErrCorruptImage = errors.New("image is corrupt")
+var ErrTimeout = errors.New("timed out while loading image")
+var ErrUnsupportedScheme = errors.New("unsupported url scheme")
+var ErrForbiddenHost = errors.New("target host is not allowed")
+var ErrImageTooLarge = errors.New("image file is too large")
+var ErrImageDimensionsTooLarge = errors.New("image dimensions are too large")
+var ErrOriginUnavailable = errors.New("origin is temporarily unavailable")
+
+// Origin is the caching metadata of the source image given by its origin
+type Origin struct {
+	ETag         string
+	LastModified string
+	// Expires is the time the image has to be revalidated, derived from Cache-Control or Expires
+	Expires time.Time
+	// NoStore is set when the origin forbids keeping the image (no-store, private), its previews are not cached
+	NoStore bool
+	// MustRevalidate forbids serving the expired image (must-revalidate, proxy-revalidate, no-cache)
+	MustRevalidate bool
+}
+
+// Fresh reports whether the image may be used without asking the origin
+func (o Origin) Fresh(now time.Time) bool {
+	return now.Before(o.Expires)
+}
+
+// Usable reports whether the expired image may still be used within the window after the expiration
+func (o Origin) Usable(now time.Time, window time.Duration) bool {
+	return window > 0 && !o.MustRevalidate && now.Before(o.Expires.Add(window))
+}
+
+// Revalidatable reports whether a conditional request can be made for the image
+func (o Origin) Revalidatable() bool {
+	return o.ETag != "" || o.LastModified != ""
+}
+
+type LoadedImage struct {
+	// Image is nil when the origin has confirmed the previous one
+	Image       image.Image
+	Origin      Origin
+	NotModified bool
+}
+
+type LoadRequest struct {
+	Url string
+	// Headers of the client are forwarded by the policy of the loader
+	Headers http.Header
+	// OriginHeaders are set by the previewer itself and sent as is
+	OriginHeaders http.Header
+	// Previous is the origin of the previously loaded image, it makes the request conditional
+	Previous *Origin
+}
 
 type ImageLoader interface {
-	Load(ctx context.Context, url string, headers http.Header) (image.Image, error)
+	Load(ctx context.Context, request *LoadRequest) (*LoadedImage, error)
 }
@@ -1,7 +1,33 @@
 package app
 
-import "image"
+import (
+	"errors"
+	"image"
+	"image/color"
+)
+
+var (
+	ErrInvalidDimensions    = errors.New("dimensions must be positive, fit and resize allow one zero side")
+	ErrDimensionsNotAllowed = errors.New("requested dimensions are not allowed")
+	ErrUnknownPreset        = errors.New("unknown size preset")
+)
+
+type ResizeMode string
+
+const (
+	ResizeModeFill   ResizeMode = "fill"
+	ResizeModeFit    ResizeMode = "fit"
+	ResizeModePad    ResizeMode = "pad"
+	ResizeModeResize ResizeMode = "resize"
+)
 
 type ImageResizer interface {
+	// Fill crops the image to fill the box
 	Fill(img image.Image, width, height int) image.Image
+	// Fit scales the image down to fit inside the box keeping the aspect ratio, zero side is not limited
+	Fit(img image.Image, width, height int) image.Image
+	// Pad fits the image and centers it on the box of the background color
+	Pad(img image.Image, width, height int, background color.Color) image.Image
+	// Resize scales the image to the exact size, zero side is calculated keeping the aspect ratio
+	Resize(img image.Image, width, height int) image.Image
 }
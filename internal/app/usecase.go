@@ -2,17 +2,21 @@ package app
 
 import (
 	"context"
-	"image"
 	"net/http"
 )
 
 type UseCase interface {
-	Fill(context.Context, *FillCommand) (image.Image, error)
+	Fill(context.Context, *FillCommand) (*EncodedImage, error)
+	// PurgeFailure forgets the remembered failure of the image url
+	PurgeFailure(ctx context.Context, url string) error
 }
 
 type FillCommand struct {
 	ImgUrl  string
-	Width   int
-	Height  int
+	Variant Variant
+	// Preset names the configured dimensions replacing the ones of the variant
+	Preset  string
 	Headers http.Header
+	// OriginHeaders are sent to the origin over the forwarded client headers
+	OriginHeaders http.Header
 }
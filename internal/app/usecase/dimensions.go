@@ -0,0 +1,100 @@
+package usecase
+
+import (
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+)
+
+// DimensionOptions limit the requested dimensions, zero means no limit
+type DimensionOptions struct {
+	MinWidth  int
+	MinHeight int
+	MaxWidth  int
+	MaxHeight int
+	// Sizes lists the allowed dimensions, an empty list allows any within the limits
+	Sizes []Size
+	// Presets are requested by the preset:{name} option instead of the dimensions, Sizes allow them too
+	Presets map[string]Size
+}
+
+type Size struct {
+	Width  int
+	Height int
+}
+
+// dimensionPolicy resolves the presets and checks the requested dimensions against the limits and the allowed sizes
+type dimensionPolicy struct {
+	limits  DimensionOptions
+	sizes   map[Size]bool
+	presets map[string]Size
+}
+
+func newDimensionPolicy(opts DimensionOptions) *dimensionPolicy {
+	var sizes map[Size]bool
+	if len(opts.Sizes) > 0 {
+		sizes = make(map[Size]bool, len(opts.Sizes)+len(opts.Presets))
+		for _, allowed := range opts.Sizes {
+			sizes[allowed] = true
+		}
+		for _, preset := range opts.Presets {
+			sizes[preset] = true
+		}
+	}
+
+	return &dimensionPolicy{
+		limits:  opts,
+		sizes:   sizes,
+		presets: opts.Presets,
+	}
+}
+
+// resolve replaces the dimensions of the variant with the ones of the preset
+func (p *dimensionPolicy) resolve(preset string, variant *app.Variant) error {
+	if preset == "" {
+		return nil
+	}
+
+	dimensions, ok := p.presets[preset]
+	if !ok {
+		return app.ErrUnknownPreset
+	}
+
+	variant.Width, variant.Height = dimensions.Width, dimensions.Height
+
+	return nil
+}
+
+func (p *dimensionPolicy) check(variant app.Variant) error {
+	width, height := variant.Width, variant.Height
+
+	if width < 0 || height < 0 {
+		return app.ErrInvalidDimensions
+	}
+
+	// fit and resize calculate the zero side, fill and pad need the whole box
+	switch variant.Mode {
+	case app.ResizeModeFit, app.ResizeModeResize:
+		if width == 0 && height == 0 {
+			return app.ErrInvalidDimensions
+		}
+	default:
+		if width == 0 || height == 0 {
+			return app.ErrInvalidDimensions
+		}
+	}
+
+	if !withinLimits(width, p.limits.MinWidth, p.limits.MaxWidth) ||
+		!withinLimits(height, p.limits.MinHeight, p.limits.MaxHeight) {
+		return app.ErrDimensionsNotAllowed
+	}
+
+	if p.sizes != nil && !p.sizes[Size{Width: width, Height: height}] {
+		return app.ErrDimensionsNotAllowed
+	}
+
+	return nil
+}
+
+// withinLimits checks the requested side, the calculated zero one is not limited
+func withinLimits(side, lower, upper int) bool {
+	return side == 0 || (side >= lower && (upper <= 0 || side <= upper))
+}
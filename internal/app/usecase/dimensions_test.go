@@ -0,0 +1,84 @@
+package usecase
+
+import (
+	"testing"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDimensionPolicy(t *testing.T) {
+	limits := DimensionOptions{
+		MinWidth:  10,
+		MinHeight: 10,
+		MaxWidth:  1000,
+		MaxHeight: 500,
+	}
+
+	t.Run("limits", func(t *testing.T) {
+		policy := newDimensionPolicy(limits)
+
+		tests := []struct {
+			name    string
+			variant app.Variant
+			err     error
+		}{
+			{name: "within limits", variant: app.Variant{Mode: app.ResizeModeFill, Width: 300, Height: 200}},
+			{name: "at limits", variant: app.Variant{Mode: app.ResizeModeFill, Width: 1000, Height: 10}},
+			{name: "negative width", variant: app.Variant{Mode: app.ResizeModeFill, Width: -300, Height: 200}, err: app.ErrInvalidDimensions},
+			{name: "negative height", variant: app.Variant{Mode: app.ResizeModeFit, Width: 300, Height: -1}, err: app.ErrInvalidDimensions},
+			{name: "fill zero side", variant: app.Variant{Mode: app.ResizeModeFill, Width: 0, Height: 200}, err: app.ErrInvalidDimensions},
+			{name: "pad zero side", variant: app.Variant{Mode: app.ResizeModePad, Width: 300, Height: 0}, err: app.ErrInvalidDimensions},
+			{name: "fit zero side", variant: app.Variant{Mode: app.ResizeModeFit, Width: 0, Height: 200}},
+			{name: "resize zero side", variant: app.Variant{Mode: app.ResizeModeResize, Width: 300, Height: 0}},
+			{name: "resize zero sides", variant: app.Variant{Mode: app.ResizeModeResize}, err: app.ErrInvalidDimensions},
+			{name: "too small", variant: app.Variant{Mode: app.ResizeModeFill, Width: 5, Height: 200}, err: app.ErrDimensionsNotAllowed},
+			{name: "too wide", variant: app.Variant{Mode: app.ResizeModeFill, Width: 1001, Height: 200}, err: app.ErrDimensionsNotAllowed},
+			{name: "too high", variant: app.Variant{Mode: app.ResizeModeFit, Width: 0, Height: 100000}, err: app.ErrDimensionsNotAllowed},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				require.Equal(t, tt.err, policy.check(tt.variant))
+			})
+		}
+	})
+
+	t.Run("sizes and presets", func(t *testing.T) {
+		opts := limits
+		opts.Sizes = []Size{{Width: 300, Height: 200}, {Width: 0, Height: 100}}
+		opts.Presets = map[string]Size{"card": {Width: 400, Height: 300}}
+		policy := newDimensionPolicy(opts)
+
+		tests := []struct {
+			name    string
+			preset  string
+			variant app.Variant
+			err     error
+		}{
+			{name: "allowed size", variant: app.Variant{Mode: app.ResizeModeFill, Width: 300, Height: 200}},
+			{name: "allowed zero side", variant: app.Variant{Mode: app.ResizeModeFit, Width: 0, Height: 100}},
+			{name: "other size", variant: app.Variant{Mode: app.ResizeModeFill, Width: 300, Height: 201}, err: app.ErrDimensionsNotAllowed},
+			{name: "preset", preset: "card", variant: app.Variant{Mode: app.ResizeModeFill}},
+			{name: "preset size", variant: app.Variant{Mode: app.ResizeModeFill, Width: 400, Height: 300}},
+			{name: "unknown preset", preset: "hero", variant: app.Variant{Mode: app.ResizeModeFill}, err: app.ErrUnknownPreset},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				variant := tt.variant
+
+				err := policy.resolve(tt.preset, &variant)
+				if err == nil {
+					err = policy.check(variant)
+				}
+				require.Equal(t, tt.err, err)
+			})
+		}
+
+		variant := app.Variant{Mode: app.ResizeModeFill}
+		require.NoError(t, policy.resolve("card", &variant))
+		require.Equal(t, 400, variant.Width)
+		require.Equal(t, 300, variant.Height)
+	})
+}
@@ -0,0 +1,149 @@
+package usecase
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+)
+
+// rememberedFailures are expected to repeat when the same url is requested again soon
+var rememberedFailures = []error{
+	app.ErrImageNotFound,
+	app.ErrContentNotImage,
+	app.ErrCorruptImage,
+	app.ErrImageTooLarge,
+	app.ErrImageDimensionsTooLarge,
+	app.ErrTimeout,
+	app.ErrBadRequest,
+	app.ErrInternal,
+	app.ErrUnknown,
+}
+
+// failureCache remembers the failed loads of the urls for a while.
+// When it is full, the expired failures are dropped first and then the random ones.
+type failureCache struct {
+	ttl        time.Duration
+	maxEntries int
+	lock       sync.Mutex
+	items      map[string]failure
+}
+
+type failure struct {
+	err     error
+	expires time.Time
+}
+
+func newFailureCache(ttl time.Duration, maxEntries int) *failureCache {
+	return &failureCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		items:      make(map[string]failure),
+	}
+}
+
+// Get returns the remembered failure of the url or nil
+func (c *failureCache) Get(url string, now time.Time) error {
+	url = failureKey(url)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	item, ok := c.items[url]
+	if !ok {
+		return nil
+	}
+
+	if !now.Before(item.expires) {
+		delete(c.items, url)
+		return nil
+	}
+
+	return item.err
+}
+
+// Add remembers the failure if it is one of the repeating ones
+func (c *failureCache) Add(url string, err error, now time.Time) {
+	if c.ttl <= 0 || !isRememberedFailure(err) {
+		return
+	}
+
+	url = failureKey(url)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, exists := c.items[url]; !exists && c.maxEntries > 0 && len(c.items) >= c.maxEntries {
+		c.evict(now)
+	}
+
+	c.items[url] = failure{err: err, expires: now.Add(c.ttl)}
+}
+
+// Purge forgets the failure of the url
+func (c *failureCache) Purge(url string) {
+	url = failureKey(url)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.items, url)
+}
+
+// evict makes room for one more item, must be called under the lock
+func (c *failureCache) evict(now time.Time) {
+	for url, item := range c.items {
+		if !now.Before(item.expires) {
+			delete(c.items, url)
+		}
+	}
+
+	for url := range c.items {
+		if len(c.items) < c.maxEntries {
+			return
+		}
+		delete(c.items, url)
+	}
+}
+
+func isRememberedFailure(err error) bool {
+	for _, failureErr := range rememberedFailures {
+		if errors.Is(err, failureErr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// failureKey makes the same image requested by the different forms of its url share the failure:
+// the web urls lose the scheme and the default port, the host is lowercased
+func failureKey(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return rawURL
+	}
+
+	scheme := strings.ToLower(parsed.Scheme)
+	if scheme != "" && scheme != "http" && scheme != "https" {
+		return rawURL
+	}
+
+	host := strings.ToLower(parsed.Host)
+	if hostname, port, err := net.SplitHostPort(host); err == nil &&
+		(port == "80" && scheme != "https" || port == "443" && scheme != "http") {
+		host = hostname
+		if strings.Contains(hostname, ":") {
+			host = "[" + hostname + "]"
+		}
+	}
+
+	parsed.Scheme, parsed.Host = "", host
+
+	return parsed.String()
+}
@@ -0,0 +1,116 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailureCache(t *testing.T) {
+	now := time.Now()
+	url := "//www.img.ru/some-img.jpg"
+
+	t.Run("repeating failures", func(t *testing.T) {
+		tests := []struct {
+			err        error
+			remembered bool
+		}{
+			{err: app.ErrImageNotFound, remembered: true},
+			{err: fmt.Errorf("%w: decode", app.ErrCorruptImage), remembered: true},
+			{err: app.ErrTimeout, remembered: true},
+			{err: app.ErrUnknown, remembered: true},
+			{err: app.ErrForbiddenHost},
+			{err: context.Canceled},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.err.Error(), func(t *testing.T) {
+				failures := newFailureCache(time.Minute, 0)
+				failures.Add(url, tt.err, now)
+
+				if !tt.remembered {
+					require.NoError(t, failures.Get(url, now))
+					return
+				}
+
+				require.Equal(t, tt.err, failures.Get(url, now))
+				require.NoError(t, failures.Get("//www.img.ru/other-img.jpg", now))
+			})
+		}
+	})
+
+	t.Run("expiration", func(t *testing.T) {
+		failures := newFailureCache(time.Minute, 0)
+		failures.Add(url, app.ErrImageNotFound, now)
+
+		require.ErrorIs(t, failures.Get(url, now.Add(59*time.Second)), app.ErrImageNotFound)
+		require.NoError(t, failures.Get(url, now.Add(time.Minute)))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		failures := newFailureCache(0, 0)
+		failures.Add(url, app.ErrImageNotFound, now)
+
+		require.NoError(t, failures.Get(url, now))
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		failures := newFailureCache(time.Minute, 0)
+		failures.Add(url, app.ErrImageNotFound, now)
+		failures.Purge(url)
+
+		require.NoError(t, failures.Get(url, now))
+	})
+
+	t.Run("purge by another form of the url", func(t *testing.T) {
+		failures := newFailureCache(time.Minute, 0)
+		failures.Add("http://WWW.img.ru:80/some-img.jpg", app.ErrImageNotFound, now)
+
+		require.ErrorIs(t, failures.Get(url, now), app.ErrImageNotFound)
+		failures.Purge(url)
+
+		require.NoError(t, failures.Get("http://www.img.ru/some-img.jpg", now))
+	})
+
+	t.Run("max entries", func(t *testing.T) {
+		failures := newFailureCache(time.Minute, 3)
+		failures.Add("expired", app.ErrImageNotFound, now.Add(-time.Hour))
+		failures.Add("first", app.ErrImageNotFound, now)
+		failures.Add("second", app.ErrImageNotFound, now)
+
+		// the expired one is dropped first
+		failures.Add("third", app.ErrImageNotFound, now)
+		require.Len(t, failures.items, 3)
+		require.NotContains(t, failures.items, "expired")
+
+		failures.Add("fourth", app.ErrImageNotFound, now)
+		require.Len(t, failures.items, 3)
+		require.Contains(t, failures.items, "fourth")
+	})
+}
+
+func TestFailureKey(t *testing.T) {
+	tests := []struct {
+		url string
+		key string
+	}{
+		{url: "//www.img.ru/some-img.jpg", key: "//www.img.ru/some-img.jpg"},
+		{url: "http://www.img.ru/some-img.jpg", key: "//www.img.ru/some-img.jpg"},
+		{url: "HTTPS://WWW.Img.ru:443/Some-Img.jpg?v=1", key: "//www.img.ru/Some-Img.jpg?v=1"},
+		{url: "http://www.img.ru:443/some-img.jpg", key: "//www.img.ru:443/some-img.jpg"},
+		{url: "//www.img.ru:8080/some-img.jpg", key: "//www.img.ru:8080/some-img.jpg"},
+		{url: "//[::1]:80/some-img.jpg", key: "//[::1]/some-img.jpg"},
+		{url: "s3://bucket/some-img.jpg", key: "s3://bucket/some-img.jpg"},
+		{url: "file:///catalog/some-img.jpg", key: "file:///catalog/some-img.jpg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			require.Equal(t, tt.key, failureKey(tt.url))
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package usecase
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+)
+
+// flightGroup coalesces concurrent calls with the same key into one execution.
+// The execution is not bound to the context of the caller who started it:
+// it keeps running while at least one caller is waiting and is cancelled when all of them have gone.
+type flightGroup struct {
+	lock  sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	img     *app.EncodedImage
+	err     error
+}
+
+type flightFunc func(ctx context.Context) (*app.EncodedImage, error)
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{
+		calls: make(map[string]*flightCall),
+	}
+}
+
+func (g *flightGroup) Do(ctx context.Context, key string, fn flightFunc) (*app.EncodedImage, error) {
+	g.lock.Lock()
+
+	call, exists := g.calls[key]
+	if !exists {
+		callCtx, cancel := context.WithCancel(detach(ctx))
+		call = &flightCall{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		g.calls[key] = call
+
+		go g.run(callCtx, key, call, fn)
+	}
+	call.waiters++
+
+	g.lock.Unlock()
+
+	select {
+	case <-call.done:
+		return call.img, call.err
+	case <-ctx.Done():
+		g.leave(key, call)
+		return nil, ctx.Err()
+	}
+}
+
+func (g *flightGroup) run(ctx context.Context, key string, call *flightCall, fn flightFunc) {
+	call.img, call.err = fn(ctx)
+
+	g.lock.Lock()
+	g.forget(key, call)
+	g.lock.Unlock()
+
+	call.cancel()
+	close(call.done)
+}
+
+func (g *flightGroup) leave(key string, call *flightCall) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	call.waiters--
+	if call.waiters == 0 {
+		// nobody needs the result anymore, the next caller starts a new execution
+		g.forget(key, call)
+		call.cancel()
+	}
+}
+
+func (g *flightGroup) forget(key string, call *flightCall) {
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
+
+// detachedContext keeps the values of the parent context but not its deadline and cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -0,0 +1,74 @@
+package usecase
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+)
+
+// negotiateFormat picks the format by the Accept header. The other formats are lossless and larger
+// than the default one for photos, so the default format is served to every client accepting it,
+// browsers do so by wildcards. The rest get the supported format with the highest quality value.
+func negotiateFormat(accept string, contentTypes map[app.ImageFormat]string) app.ImageFormat {
+	if acceptsDefault(accept, contentTypes[app.DefaultImageFormat]) {
+		return app.DefaultImageFormat
+	}
+
+	format, bestQuality := app.DefaultImageFormat, 0.0
+
+	formats := make(map[string]app.ImageFormat, len(contentTypes))
+	for f, contentType := range contentTypes {
+		formats[contentType] = f
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, quality := parseAcceptPart(part)
+
+		f, ok := formats[mediaType]
+		if ok && quality > bestQuality {
+			format, bestQuality = f, quality
+		}
+	}
+
+	return format
+}
+
+// acceptsDefault finds the quality value of the default content type, the most specific media range wins
+func acceptsDefault(accept, contentType string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, quality := parseAcceptPart(part)
+		qualities[mediaType] = quality
+	}
+
+	mainType := strings.SplitN(contentType, "/", 2)[0]
+	for _, mediaRange := range []string{contentType, mainType + "/*", "*/*"} {
+		if quality, ok := qualities[mediaRange]; ok {
+			return quality > 0
+		}
+	}
+
+	return false
+}
+
+func parseAcceptPart(part string) (string, float64) {
+	params := strings.Split(part, ";")
+	mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+	quality := 1.0
+
+	for _, param := range params[1:] {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+			if q, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil {
+				quality = q
+			}
+		}
+	}
+
+	return mediaType, quality
+}
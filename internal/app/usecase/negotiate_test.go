@@ -0,0 +1,39 @@
+package usecase
+
+import (
+	"testing"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	contentTypes := fakeEncoder{}.ContentTypes()
+
+	tests := []struct {
+		accept string
+		format app.ImageFormat
+	}{
+		{accept: "", format: app.ImageFormatJPEG},
+		{accept: "*/*", format: app.ImageFormatJPEG},
+		// chrome, firefox and safari
+		{accept: "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", format: app.ImageFormatJPEG},
+		{accept: "image/avif,image/webp,*/*", format: app.ImageFormatJPEG},
+		{accept: "image/webp,image/avif,image/jxl,image/heic,image/heic-sequence,video/*;q=0.8,image/png,image/svg+xml,image/*;q=0.8,*/*;q=0.5", format: app.ImageFormatJPEG},
+		{accept: "image/png, image/jpeg;q=0.5", format: app.ImageFormatJPEG},
+		{accept: "image/webp;q=0.5, image/png", format: app.ImageFormatPNG},
+		{accept: "image/png, image/gif;q=0.5", format: app.ImageFormatPNG},
+		{accept: "image/png, image/*;q=0", format: app.ImageFormatPNG},
+		{accept: "image/png, image/jpeg;q=0, */*", format: app.ImageFormatPNG},
+		{accept: "IMAGE/WEBP", format: app.ImageFormatJPEG},
+		{accept: "image/webp;q=0", format: app.ImageFormatJPEG},
+		{accept: "image/avif", format: app.ImageFormatJPEG},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.accept, func(t *testing.T) {
+			require.Equal(t, tc.format, negotiateFormat(tc.accept, contentTypes))
+		})
+	}
+}
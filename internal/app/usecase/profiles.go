@@ -0,0 +1,58 @@
+package usecase
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+)
+
+// ProfileRoute sends the images of the matching hosts to the use case set up for them
+type ProfileRoute struct {
+	Name string
+	// Hosts are the exact names and glob patterns like *.example.com
+	Hosts   []string
+	UseCase app.UseCase
+}
+
+// ProfileRouter picks the use case by the host of the image, the first matching route wins
+type ProfileRouter struct {
+	fallback app.UseCase
+	routes   []ProfileRoute
+}
+
+func NewProfileRouter(fallback app.UseCase, routes ...ProfileRoute) *ProfileRouter {
+	return &ProfileRouter{
+		fallback: fallback,
+		routes:   routes,
+	}
+}
+
+func (r *ProfileRouter) Fill(ctx context.Context, command *app.FillCommand) (*app.EncodedImage, error) {
+	return r.route(command.ImgUrl).Fill(ctx, command)
+}
+
+func (r *ProfileRouter) PurgeFailure(ctx context.Context, url string) error {
+	return r.route(url).PurgeFailure(ctx, url)
+}
+
+func (r *ProfileRouter) route(imgUrl string) app.UseCase {
+	parsedUrl, err := url.Parse(imgUrl)
+	if err != nil {
+		return r.fallback
+	}
+
+	host := strings.ToLower(parsedUrl.Hostname())
+
+	for _, route := range r.routes {
+		for _, pattern := range route.Hosts {
+			if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+				return route.UseCase
+			}
+		}
+	}
+
+	return r.fallback
+}
@@ -0,0 +1,48 @@
+package usecase
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+	"github.com/stretchr/testify/require"
+)
+
+// namedUseCase answers with its name to tell which profile has been picked
+type namedUseCase string
+
+func (n namedUseCase) Fill(ctx context.Context, command *app.FillCommand) (*app.EncodedImage, error) {
+	return &app.EncodedImage{Data: []byte(n)}, nil
+}
+
+func (n namedUseCase) PurgeFailure(ctx context.Context, url string) error {
+	return nil
+}
+
+func TestProfileRouter(t *testing.T) {
+	router := NewProfileRouter(
+		namedUseCase("default"),
+		ProfileRoute{Name: "catalog", Hosts: []string{"catalog.example.com", "*.cdn.example.com"}, UseCase: namedUseCase("catalog")},
+		ProfileRoute{Name: "wildcard", Hosts: []string{"*.example.com"}, UseCase: namedUseCase("wildcard")},
+	)
+
+	tests := []struct {
+		url     string
+		profile string
+	}{
+		{url: "//catalog.example.com/img.jpg", profile: "catalog"},
+		{url: "https://CATALOG.example.com:8443/img.jpg", profile: "catalog"},
+		{url: "//eu.cdn.example.com/img.jpg", profile: "catalog"},
+		{url: "//blog.example.com/img.jpg", profile: "wildcard"},
+		{url: "//example.com/img.jpg", profile: "default"},
+		{url: "//127.0.0.1:8080/img.jpg", profile: "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			img, err := router.Fill(context.Background(), &app.FillCommand{ImgUrl: tt.url})
+			require.NoError(t, err)
+			require.Equal(t, tt.profile, string(img.Data))
+		})
+	}
+}
@@ -3,53 +3,260 @@ package usecase
 import (
 	"context"
 	"image"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/alexandr-lakeev/otus-final-project/internal/app"
 )
 
+// Options are the policies of the use case, the zero value disables them
+type Options struct {
+	Stale      StaleOptions
+	Failures   FailureOptions
+	Dimensions DimensionOptions
+}
+
+// StaleOptions allow serving the expired previews, a zero window disables the mode
+type StaleOptions struct {
+	// WhileRevalidate serves the expired preview at once and refreshes it in the background
+	WhileRevalidate time.Duration
+	// IfError serves the expired preview when the refresh fails
+	IfError time.Duration
+}
+
+// FailureOptions keep the failed loads of the urls, a zero TTL disables it
+type FailureOptions struct {
+	TTL        time.Duration
+	MaxEntries int
+}
+
 type UseCase struct {
-	loader  app.ImageLoader
-	resizer app.ImageResizer
-	cache   app.Cache
-	logger  app.Logger
+	loader     app.ImageLoader
+	resizer    app.ImageResizer
+	encoder    app.ImageEncoder
+	cache      app.Cache
+	logger     app.Logger
+	stale      StaleOptions
+	dimensions *dimensionPolicy
+	flights    *flightGroup
+	failures   *failureCache
 }
 
-func New(loader app.ImageLoader, resizer app.ImageResizer, cache app.Cache, logger app.Logger) *UseCase {
+func New(
+	loader app.ImageLoader,
+	resizer app.ImageResizer,
+	encoder app.ImageEncoder,
+	cache app.Cache,
+	logger app.Logger,
+	opts Options,
+) *UseCase {
 	return &UseCase{
-		loader:  loader,
-		resizer: resizer,
-		cache:   cache,
-		logger:  logger,
+		loader:     loader,
+		resizer:    resizer,
+		encoder:    encoder,
+		cache:      cache,
+		logger:     logger,
+		stale:      opts.Stale,
+		dimensions: newDimensionPolicy(opts.Dimensions),
+		flights:    newFlightGroup(),
+		failures:   newFailureCache(opts.Failures.TTL, opts.Failures.MaxEntries),
 	}
 }
 
-func (u *UseCase) Fill(ctx context.Context, command *app.FillCommand) (image.Image, error) {
+func (u *UseCase) Fill(ctx context.Context, command *app.FillCommand) (*app.EncodedImage, error) {
 	errNotFound := app.ErrNotFoundInCache
 
-	img, err := u.cache.Get(command.ImgUrl, command.Width, command.Height)
-	if err == nil {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// the command may be shared by the caller, the resolved variant is kept in a copy
+	resolved := *command
+	command = &resolved
+
+	contentTypes := u.encoder.ContentTypes()
+	if command.Variant.Format == "" {
+		command.Variant.Format = negotiateFormat(command.Headers.Get("Accept"), contentTypes)
+	}
+
+	if _, ok := contentTypes[command.Variant.Format]; !ok {
+		return nil, app.ErrUnsupportedFormat
+	}
+
+	if err := u.dimensions.resolve(command.Preset, &command.Variant); err != nil {
+		return nil, err
+	}
+
+	if err := u.dimensions.check(command.Variant); err != nil {
+		return nil, err
+	}
+
+	command.Variant.Quality = u.encoder.Quality(command.Variant.Format, command.Variant.Quality)
+
+	now := time.Now()
+
+	encodedImg, err := u.cache.Get(ctx, command.ImgUrl, command.Variant)
+	if err == nil && encodedImg.Origin.Fresh(now) {
 		u.logger.Info("got image from cache")
-		return img, nil
+		return withCacheStatus(encodedImg, app.CacheStatusHit), nil
 	}
 
-	if !errors.Is(err, errNotFound) {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+
+	var expired *app.EncodedImage
+	switch {
+	case err == nil:
+		expired = encodedImg
+	case !errors.Is(err, errNotFound):
 		u.logger.Error(errors.Wrap(err, "cache read error").Error())
 	}
 
-	img, err = u.loader.Load(ctx, command.ImgUrl, command.Headers)
+	if expired != nil && expired.Origin.Usable(now, u.stale.WhileRevalidate) {
+		u.logger.Info("got stale image from cache, refreshing in background")
+		u.refresh(ctx, command, expired)
+		return withCacheStatus(expired, app.CacheStatusStale), nil
+	}
+
+	// identical requests arriving while the image is being prepared wait for the same result
+	filledImg, err := u.flights.Do(ctx, u.getFlightKey(command), func(ctx context.Context) (*app.EncodedImage, error) {
+		return u.fill(ctx, command, expired)
+	})
+
+	if err != nil && ctx.Err() == nil && u.servableIfError(expired, err) {
+		u.logger.Warning(errors.Wrap(err, "serving stale image after refresh error").Error())
+		return withCacheStatus(expired, app.CacheStatusStale), nil
+	}
+
+	return filledImg, err
+}
+
+// PurgeFailure forgets the failed load of the image, so the next request goes to the origin
+func (u *UseCase) PurgeFailure(ctx context.Context, url string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	u.failures.Purge(url)
+
+	return nil
+}
+
+// refresh updates the expired image without making the request wait for it
+func (u *UseCase) refresh(ctx context.Context, command *app.FillCommand, expired *app.EncodedImage) {
+	ctx = detach(ctx)
+
+	go func() {
+		_, err := u.flights.Do(ctx, u.getFlightKey(command), func(ctx context.Context) (*app.EncodedImage, error) {
+			return u.fill(ctx, command, expired)
+		})
+		if err != nil {
+			u.logger.Warning(errors.Wrap(err, "background refresh error").Error())
+		}
+	}()
+}
+
+// servableIfError reports whether the expired image may replace the error of its refresh,
+// the image known to be removed from the origin is not served
+func (u *UseCase) servableIfError(expired *app.EncodedImage, err error) bool {
+	return expired != nil &&
+		expired.Origin.Usable(time.Now(), u.stale.IfError) &&
+		!errors.Is(err, app.ErrImageNotFound)
+}
+
+// fill prepares the image, the expired one is revalidated with the origin before a full download
+func (u *UseCase) fill(
+	ctx context.Context,
+	command *app.FillCommand,
+	expired *app.EncodedImage,
+) (*app.EncodedImage, error) {
+	var previous *app.Origin
+	if expired != nil && expired.Origin.Revalidatable() {
+		previous = &expired.Origin
+	}
+
+	if err := u.failures.Get(command.ImgUrl, time.Now()); err != nil {
+		u.logger.Info("image has recently failed to load")
+		return nil, err
+	}
+
+	loaded, err := u.loader.Load(ctx, &app.LoadRequest{
+		Url:           command.ImgUrl,
+		Headers:       command.Headers,
+		OriginHeaders: command.OriginHeaders,
+		Previous:      previous,
+	})
 	if err != nil {
+		u.failures.Add(command.ImgUrl, err, time.Now())
 		return nil, err
 	}
 
+	if loaded.NotModified {
+		u.logger.Info("image is not modified on remote")
+
+		revalidated := *expired
+		revalidated.Origin = loaded.Origin
+		u.store(ctx, command, &revalidated)
+
+		return withCacheStatus(&revalidated, app.CacheStatusRevalidated), nil
+	}
+
 	u.logger.Info("got image from remote")
 
-	resizedImg := u.resizer.Fill(img, command.Width, command.Height)
+	resizedImg := u.resize(loaded.Image, command.Variant)
+
+	// the resize is not interruptible, so the cancellation is checked before the next step
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	encodedImg, err := u.encoder.Encode(resizedImg, command.Variant.Format, command.Variant.Quality)
+	if err != nil {
+		return nil, errors.Wrap(err, "encode error")
+	}
+
+	encodedImg.ETag = app.NewETag(encodedImg.Data)
+	encodedImg.LastModified = time.Now().UTC()
+	encodedImg.Origin = loaded.Origin
 
-	if err := u.cache.Set(command.ImgUrl, command.Width, command.Height, resizedImg); err != nil {
+	u.store(ctx, command, encodedImg)
+
+	return withCacheStatus(encodedImg, app.CacheStatusMiss), nil
+}
+
+func (u *UseCase) store(ctx context.Context, command *app.FillCommand, encodedImg *app.EncodedImage) {
+	if encodedImg.Origin.NoStore {
+		return
+	}
+
+	if err := u.cache.Set(ctx, command.ImgUrl, command.Variant, encodedImg); err != nil && ctx.Err() == nil {
 		u.logger.Error(errors.Wrap(err, "cache set error").Error())
 	}
+}
+
+func (u *UseCase) resize(img image.Image, variant app.Variant) image.Image {
+	switch variant.Mode {
+	case app.ResizeModeFit:
+		return u.resizer.Fit(img, variant.Width, variant.Height)
+	case app.ResizeModePad:
+		return u.resizer.Pad(img, variant.Width, variant.Height, variant.Background)
+	case app.ResizeModeResize:
+		return u.resizer.Resize(img, variant.Width, variant.Height)
+	default:
+		return u.resizer.Fill(img, variant.Width, variant.Height)
+	}
+}
+
+// withCacheStatus copies the image, since the cached one may be shared
+func withCacheStatus(img *app.EncodedImage, status app.CacheStatus) *app.EncodedImage {
+	result := *img
+	result.CacheStatus = status
+
+	return &result
+}
 
-	return resizedImg, nil
+func (u *UseCase) getFlightKey(command *app.FillCommand) string {
+	return command.ImgUrl + "|" + command.Variant.String()
 }
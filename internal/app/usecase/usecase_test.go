@@ -0,0 +1,499 @@
+package usecase
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeLoader struct {
+	calls   int32
+	started chan struct{}
+	release chan struct{}
+	err     error
+	ctxErr  chan error
+	// origin of the loaded images, they are fresh for an hour by default
+	origin app.Origin
+}
+
+func newFakeLoader() *fakeLoader {
+	return &fakeLoader{
+		started: make(chan struct{}, 100),
+		release: make(chan struct{}),
+		ctxErr:  make(chan error, 100),
+	}
+}
+
+func (l *fakeLoader) Load(ctx context.Context, request *app.LoadRequest) (*app.LoadedImage, error) {
+	atomic.AddInt32(&l.calls, 1)
+	l.started <- struct{}{}
+
+	select {
+	case <-l.release:
+	case <-ctx.Done():
+		l.ctxErr <- ctx.Err()
+		return nil, ctx.Err()
+	}
+
+	if l.err != nil {
+		return nil, l.err
+	}
+
+	origin := l.origin
+	if origin.Expires.IsZero() {
+		origin.Expires = time.Now().Add(time.Hour)
+	}
+
+	return &app.LoadedImage{
+		Image:  image.NewNRGBA(image.Rect(0, 0, 10, 10)),
+		Origin: origin,
+	}, nil
+}
+
+type fakeResizer struct{}
+
+func (fakeResizer) Fill(img image.Image, width, height int) image.Image {
+	return img
+}
+
+func (fakeResizer) Fit(img image.Image, width, height int) image.Image {
+	return img
+}
+
+func (fakeResizer) Pad(img image.Image, width, height int, background color.Color) image.Image {
+	return img
+}
+
+func (fakeResizer) Resize(img image.Image, width, height int) image.Image {
+	return img
+}
+
+type fakeEncoder struct{}
+
+func (fakeEncoder) Encode(img image.Image, format app.ImageFormat, quality int) (*app.EncodedImage, error) {
+	return &app.EncodedImage{Data: []byte("encoded"), ContentType: fakeEncoder{}.ContentTypes()[format]}, nil
+}
+
+func (fakeEncoder) ContentTypes() map[app.ImageFormat]string {
+	return map[app.ImageFormat]string{
+		app.ImageFormatJPEG: "image/jpeg",
+		app.ImageFormatPNG:  "image/png",
+	}
+}
+
+func (fakeEncoder) Quality(format app.ImageFormat, requested int) int {
+	return requested
+}
+
+type fakeCache struct{}
+
+func (fakeCache) Get(ctx context.Context, url string, variant app.Variant) (*app.EncodedImage, error) {
+	return nil, app.ErrNotFoundInCache
+}
+
+func (fakeCache) Set(ctx context.Context, url string, variant app.Variant, img *app.EncodedImage) error {
+	return nil
+}
+
+type memoryCache struct {
+	lock  sync.Mutex
+	items map[string]*app.EncodedImage
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{items: make(map[string]*app.EncodedImage)}
+}
+
+func (c *memoryCache) Get(ctx context.Context, url string, variant app.Variant) (*app.EncodedImage, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	img, ok := c.items[url+variant.String()]
+	if !ok {
+		return nil, app.ErrNotFoundInCache
+	}
+
+	return img, nil
+}
+
+func (c *memoryCache) Set(ctx context.Context, url string, variant app.Variant, img *app.EncodedImage) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.items[url+variant.String()] = img
+
+	return nil
+}
+
+type fakeLogger struct{}
+
+func (fakeLogger) Debug(msg string)   {}
+func (fakeLogger) Info(msg string)    {}
+func (fakeLogger) Warning(msg string) {}
+func (fakeLogger) Error(msg string)   {}
+func (fakeLogger) Panic(msg string)   {}
+
+func newTestUseCase(loader app.ImageLoader) *UseCase {
+	return New(loader, fakeResizer{}, fakeEncoder{}, fakeCache{}, fakeLogger{}, Options{})
+}
+
+func TestFillCoalescing(t *testing.T) {
+	command := &app.FillCommand{
+		ImgUrl:  "//www.img.ru/some-img.jpg",
+		Variant: app.Variant{Mode: app.ResizeModeFill, Width: 100, Height: 100},
+	}
+
+	t.Run("identical requests load once", func(t *testing.T) {
+		loader := newFakeLoader()
+		uc := newTestUseCase(loader)
+
+		const waiters = 50
+		results := make(chan *app.EncodedImage, waiters)
+		errs := make(chan error, waiters)
+
+		wg := sync.WaitGroup{}
+		wg.Add(waiters)
+
+		for i := 0; i < waiters; i++ {
+			go func() {
+				defer wg.Done()
+
+				img, err := uc.Fill(context.Background(), command)
+				results <- img
+				errs <- err
+			}()
+		}
+
+		<-loader.started
+		waitForWaiters(t, uc, waiters)
+		close(loader.release)
+		wg.Wait()
+		close(results)
+		close(errs)
+
+		require.EqualValues(t, 1, atomic.LoadInt32(&loader.calls))
+		for err := range errs {
+			require.NoError(t, err)
+		}
+		for img := range results {
+			require.Equal(t, []byte("encoded"), img.Data)
+		}
+	})
+
+	t.Run("different variants load separately", func(t *testing.T) {
+		loader := newFakeLoader()
+		close(loader.release)
+		uc := newTestUseCase(loader)
+
+		_, err := uc.Fill(context.Background(), command)
+		require.NoError(t, err)
+
+		_, err = uc.Fill(context.Background(), &app.FillCommand{
+			ImgUrl:  command.ImgUrl,
+			Variant: app.Variant{Mode: app.ResizeModeFill, Width: 200, Height: 100},
+		})
+		require.NoError(t, err)
+
+		_, err = uc.Fill(context.Background(), &app.FillCommand{
+			ImgUrl:  command.ImgUrl,
+			Variant: app.Variant{Mode: app.ResizeModeFit, Width: 100, Height: 100},
+		})
+		require.NoError(t, err)
+
+		require.EqualValues(t, 3, atomic.LoadInt32(&loader.calls))
+	})
+
+	t.Run("error is shared", func(t *testing.T) {
+		loader := newFakeLoader()
+		loader.err = app.ErrImageNotFound
+		uc := newTestUseCase(loader)
+
+		const waiters = 10
+		errs := make(chan error, waiters)
+
+		for i := 0; i < waiters; i++ {
+			go func() {
+				_, err := uc.Fill(context.Background(), command)
+				errs <- err
+			}()
+		}
+
+		<-loader.started
+		waitForWaiters(t, uc, waiters)
+		close(loader.release)
+
+		for i := 0; i < waiters; i++ {
+			require.ErrorIs(t, <-errs, app.ErrImageNotFound)
+		}
+		require.EqualValues(t, 1, atomic.LoadInt32(&loader.calls))
+	})
+
+	t.Run("cancelled waiter does not abort others", func(t *testing.T) {
+		loader := newFakeLoader()
+		uc := newTestUseCase(loader)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelledErr := make(chan error, 1)
+
+		go func() {
+			_, err := uc.Fill(ctx, command)
+			cancelledErr <- err
+		}()
+
+		<-loader.started
+
+		result := make(chan error, 1)
+		go func() {
+			_, err := uc.Fill(context.Background(), command)
+			result <- err
+		}()
+
+		waitForWaiters(t, uc, 2)
+		cancel()
+		require.ErrorIs(t, <-cancelledErr, context.Canceled)
+
+		close(loader.release)
+		require.NoError(t, <-result)
+		require.EqualValues(t, 1, atomic.LoadInt32(&loader.calls))
+	})
+
+	t.Run("cancelled request does not start a load", func(t *testing.T) {
+		loader := newFakeLoader()
+		uc := newTestUseCase(loader)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := uc.Fill(ctx, command)
+		require.ErrorIs(t, err, context.Canceled)
+		require.EqualValues(t, 0, atomic.LoadInt32(&loader.calls))
+	})
+
+	t.Run("load is cancelled when all waiters have gone", func(t *testing.T) {
+		loader := newFakeLoader()
+		uc := newTestUseCase(loader)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelledErr := make(chan error, 1)
+
+		go func() {
+			_, err := uc.Fill(ctx, command)
+			cancelledErr <- err
+		}()
+
+		<-loader.started
+		cancel()
+
+		require.ErrorIs(t, <-cancelledErr, context.Canceled)
+		require.ErrorIs(t, <-loader.ctxErr, context.Canceled)
+
+		// the next request starts a new load
+		close(loader.release)
+		_, err := uc.Fill(context.Background(), command)
+		require.NoError(t, err)
+		require.EqualValues(t, 2, atomic.LoadInt32(&loader.calls))
+	})
+}
+
+func TestFillStale(t *testing.T) {
+	command := &app.FillCommand{
+		ImgUrl:  "//www.img.ru/some-img.jpg",
+		Variant: app.Variant{Mode: app.ResizeModeFill, Width: 100, Height: 100, Format: app.ImageFormatJPEG},
+	}
+
+	newUseCaseWithOrigin := func(loader app.ImageLoader, stale StaleOptions, origin app.Origin) (*UseCase, *memoryCache) {
+		cache := newMemoryCache()
+		if !origin.Expires.IsZero() {
+			cache.Set(context.Background(), command.ImgUrl, command.Variant, &app.EncodedImage{
+				Data:        []byte("stale"),
+				ContentType: "image/jpeg",
+				Origin:      origin,
+			})
+		}
+
+		return New(loader, fakeResizer{}, fakeEncoder{}, cache, fakeLogger{}, Options{Stale: stale}), cache
+	}
+
+	newUseCase := func(loader app.ImageLoader, stale StaleOptions, expiredFor time.Duration) (*UseCase, *memoryCache) {
+		var origin app.Origin
+		if expiredFor > 0 {
+			origin.Expires = time.Now().Add(-expiredFor)
+		}
+
+		return newUseCaseWithOrigin(loader, stale, origin)
+	}
+
+	t.Run("miss then hit", func(t *testing.T) {
+		loader := newFakeLoader()
+		close(loader.release)
+		uc, _ := newUseCase(loader, StaleOptions{}, 0)
+
+		img, err := uc.Fill(context.Background(), command)
+		require.NoError(t, err)
+		require.Equal(t, app.CacheStatusMiss, img.CacheStatus)
+
+		img, err = uc.Fill(context.Background(), command)
+		require.NoError(t, err)
+		require.Equal(t, app.CacheStatusHit, img.CacheStatus)
+		require.EqualValues(t, 1, atomic.LoadInt32(&loader.calls))
+	})
+
+	t.Run("not stored", func(t *testing.T) {
+		loader := newFakeLoader()
+		loader.origin = app.Origin{NoStore: true}
+		close(loader.release)
+		uc, cache := newUseCase(loader, StaleOptions{}, 0)
+
+		for i := 0; i < 2; i++ {
+			img, err := uc.Fill(context.Background(), command)
+			require.NoError(t, err)
+			require.Equal(t, app.CacheStatusMiss, img.CacheStatus)
+		}
+		require.EqualValues(t, 2, atomic.LoadInt32(&loader.calls))
+
+		_, err := cache.Get(context.Background(), command.ImgUrl, command.Variant)
+		require.ErrorIs(t, err, app.ErrNotFoundInCache)
+	})
+
+	t.Run("stale while revalidate", func(t *testing.T) {
+		loader := newFakeLoader()
+		uc, cache := newUseCase(loader, StaleOptions{WhileRevalidate: time.Minute}, time.Second)
+
+		// the load is blocked, so the stale image is returned without waiting for it
+		img, err := uc.Fill(context.Background(), command)
+		require.NoError(t, err)
+		require.Equal(t, app.CacheStatusStale, img.CacheStatus)
+		require.Equal(t, []byte("stale"), img.Data)
+
+		<-loader.started
+		close(loader.release)
+
+		require.Eventually(t, func() bool {
+			cached, err := cache.Get(context.Background(), command.ImgUrl, command.Variant)
+			return err == nil && string(cached.Data) == "encoded"
+		}, time.Second, time.Millisecond)
+
+		img, err = uc.Fill(context.Background(), command)
+		require.NoError(t, err)
+		require.Equal(t, app.CacheStatusHit, img.CacheStatus)
+		require.EqualValues(t, 1, atomic.LoadInt32(&loader.calls))
+	})
+
+	t.Run("expired beyond revalidate window", func(t *testing.T) {
+		loader := newFakeLoader()
+		close(loader.release)
+		uc, _ := newUseCase(loader, StaleOptions{WhileRevalidate: time.Minute}, time.Hour)
+
+		img, err := uc.Fill(context.Background(), command)
+		require.NoError(t, err)
+		require.Equal(t, app.CacheStatusMiss, img.CacheStatus)
+		require.Equal(t, []byte("encoded"), img.Data)
+	})
+
+	t.Run("origin forbids stale", func(t *testing.T) {
+		stale := StaleOptions{WhileRevalidate: time.Hour, IfError: time.Hour}
+		origin := app.Origin{Expires: time.Now().Add(-time.Second), MustRevalidate: true}
+
+		loader := newFakeLoader()
+		close(loader.release)
+		uc, _ := newUseCaseWithOrigin(loader, stale, origin)
+
+		img, err := uc.Fill(context.Background(), command)
+		require.NoError(t, err)
+		require.Equal(t, app.CacheStatusMiss, img.CacheStatus)
+
+		loader = newFakeLoader()
+		loader.err = app.ErrTimeout
+		close(loader.release)
+		uc, _ = newUseCaseWithOrigin(loader, stale, origin)
+
+		_, err = uc.Fill(context.Background(), command)
+		require.ErrorIs(t, err, app.ErrTimeout)
+	})
+
+	tests := []struct {
+		name       string
+		err        error
+		expiredFor time.Duration
+		stale      bool
+	}{
+		{name: "stale if error", err: app.ErrTimeout, expiredFor: time.Minute, stale: true},
+		{name: "stale if origin error", err: app.ErrInternal, expiredFor: time.Minute, stale: true},
+		{name: "removed image is not served", err: app.ErrImageNotFound, expiredFor: time.Minute},
+		{name: "expired beyond error window", err: app.ErrTimeout, expiredFor: 2 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loader := newFakeLoader()
+			loader.err = tt.err
+			close(loader.release)
+			uc, _ := newUseCase(loader, StaleOptions{IfError: time.Hour}, tt.expiredFor)
+
+			img, err := uc.Fill(context.Background(), command)
+			if !tt.stale {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, app.CacheStatusStale, img.CacheStatus)
+			require.Equal(t, []byte("stale"), img.Data)
+		})
+	}
+}
+
+func TestFillNegativeCache(t *testing.T) {
+	command := &app.FillCommand{
+		ImgUrl:  "//www.img.ru/some-img.jpg",
+		Variant: app.Variant{Mode: app.ResizeModeFill, Width: 100, Height: 100},
+	}
+
+	loader := newFakeLoader()
+	loader.err = app.ErrImageNotFound
+	close(loader.release)
+
+	uc := New(loader, fakeResizer{}, fakeEncoder{}, fakeCache{}, fakeLogger{}, Options{
+		Failures: FailureOptions{TTL: time.Minute},
+	})
+
+	_, err := uc.Fill(context.Background(), command)
+	require.ErrorIs(t, err, app.ErrImageNotFound)
+
+	// another variant of the same image fails without a load
+	_, err = uc.Fill(context.Background(), &app.FillCommand{
+		ImgUrl:  command.ImgUrl,
+		Variant: app.Variant{Mode: app.ResizeModeFit, Width: 50, Height: 50},
+	})
+	require.ErrorIs(t, err, app.ErrImageNotFound)
+	require.EqualValues(t, 1, atomic.LoadInt32(&loader.calls))
+
+	require.NoError(t, uc.PurgeFailure(context.Background(), command.ImgUrl))
+
+	_, err = uc.Fill(context.Background(), command)
+	require.ErrorIs(t, err, app.ErrImageNotFound)
+	require.EqualValues(t, 2, atomic.LoadInt32(&loader.calls))
+}
+
+func waitForWaiters(t *testing.T, uc *UseCase, waiters int) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		uc.flights.lock.Lock()
+		defer uc.flights.lock.Unlock()
+
+		total := 0
+		for _, call := range uc.flights.calls {
+			total += call.waiters
+		}
+
+		return total == waiters
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,31 @@
+package app
+
+import (
+	"fmt"
+	"image/color"
+)
+
+// Variant describes how the source image is prepared, together with the image url it identifies the preview
+type Variant struct {
+	Mode       ResizeMode
+	Width      int
+	Height     int
+	Background color.NRGBA
+	Format     ImageFormat
+	Quality    int
+}
+
+func (v Variant) String() string {
+	key := fmt.Sprintf("%s/%d/%d/%s", v.Mode, v.Width, v.Height, v.Format)
+
+	if v.Mode == ResizeModePad {
+		bg := v.Background
+		key += fmt.Sprintf("/bg:%02x%02x%02x%02x", bg.R, bg.G, bg.B, bg.A)
+	}
+
+	if v.Quality > 0 {
+		key += fmt.Sprintf("/q:%d", v.Quality)
+	}
+
+	return key
+}
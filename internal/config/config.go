@@ -21,12 +21,205 @@ type (
 		ReadTimeout  time.Duration `yaml:"http_read_timeout" config:"http_read_timeout"`
 		WriteTimeout time.Duration `yaml:"http_write_timeout" config:"http_write_timeout"`
 		IdleTimeout  time.Duration `yaml:"http_idle_timeout" config:"http_idle_timeout"`
+		Signature    SignatureConf `yaml:"signature"`
+		HTTPCache    HTTPCacheConf `yaml:"http_cache"`
+		Origins      OriginsConf   `yaml:"origins"`
+		Admin        AdminConf     `yaml:"admin"`
+	}
+
+	// AdminConf protects the administrative routes, an empty token disables them
+	AdminConf struct {
+		Token string `yaml:"token" config:"admin_token"`
+	}
+
+	OriginsConf struct {
+		// Raw allows the urls of arbitrary origins in the requests, otherwise only the aliases are served
+		Raw     bool        `yaml:"raw" config:"origins_raw"`
+		Aliases []AliasConf `yaml:"aliases"`
+	}
+
+	// AliasConf maps /@{name}/{path} of the request to the url of the origin
+	AliasConf struct {
+		Name string `yaml:"name"`
+		// BaseURL is prepended to the path, e.g. https://catalog.internal:8443/images
+		BaseURL string      `yaml:"base_url"`
+		Rewrite RewriteConf `yaml:"rewrite"`
+		// Headers are sent to the origin as is
+		Headers map[string]string `yaml:"headers"`
+	}
+
+	// RewriteConf replaces the prefix of the path
+	RewriteConf struct {
+		From string `yaml:"from"`
+		To   string `yaml:"to"`
+	}
+
+	// HTTPCacheConf sets the caching headers of the previews for the browsers and CDNs
+	HTTPCacheConf struct {
+		// MaxAge of zero makes the clients revalidate every time, it is capped by the freshness of the source
+		MaxAge time.Duration `yaml:"max_age" config:"http_cache_max_age"`
+		// Directives are appended to Cache-Control, e.g. "public, immutable"
+		Directives string `yaml:"directives" config:"http_cache_directives"`
+	}
+
+	SignatureConf struct {
+		// Keys verify the url signatures, the first one is used for signing
+		Keys []string `yaml:"keys"`
+		// Unsafe accepts the urls without a signature, it is meant for development only
+		Unsafe bool `yaml:"unsafe" config:"signature_unsafe"`
 	}
 
 	PreviewerConf struct {
-		RequestTimeout time.Duration `yaml:"request_timeout" config:"request_timeout"`
-		CacheSize      int           `yaml:"cache_size" config:"cache_size"`
-		CacheDir       string        `yaml:"cache_dir" config:"cache_dir"`
+		RequestTimeout      time.Duration     `yaml:"request_timeout" config:"request_timeout"`
+		CacheSize           int               `yaml:"cache_size" config:"cache_size"`
+		CacheMaxBytes       int64             `yaml:"cache_max_bytes" config:"cache_max_bytes"`
+		CacheDir            string            `yaml:"cache_dir" config:"cache_dir"`
+		MemoryCacheMaxBytes int64             `yaml:"memory_cache_max_bytes" config:"memory_cache_max_bytes"`
+		Loader              LoaderConf        `yaml:"loader"`
+		Encoder             EncoderConf       `yaml:"encoder"`
+		Stale               StaleConf         `yaml:"stale"`
+		NegativeCache       NegativeCacheConf `yaml:"negative_cache"`
+		Resizer             ResizerConf       `yaml:"resizer"`
+		Profiles            []ProfileConf     `yaml:"profiles"`
+	}
+
+	// ProfileConf overrides the settings for the images of the matching origins,
+	// the settings missing in the file are inherited from the default ones
+	ProfileConf struct {
+		Name string `yaml:"name"`
+		// Hosts are the exact names and glob patterns like *.example.com
+		Hosts          []string          `yaml:"hosts"`
+		RequestTimeout time.Duration     `yaml:"request_timeout"`
+		Loader         LoaderConf        `yaml:"loader"`
+		Resizer        ResizerConf       `yaml:"resizer"`
+		Encoder        EncoderConf       `yaml:"encoder"`
+		Stale          StaleConf         `yaml:"stale"`
+		NegativeCache  NegativeCacheConf `yaml:"negative_cache"`
+		// keys are the settings given in the file, they override the defaults even with the zero values
+		keys map[interface{}]interface{}
+	}
+
+	// ResizerConf limits the requested dimensions, zero means no limit
+	ResizerConf struct {
+		MinWidth  int `yaml:"min_width" config:"min_width"`
+		MinHeight int `yaml:"min_height" config:"min_height"`
+		MaxWidth  int `yaml:"max_width" config:"max_width"`
+		MaxHeight int `yaml:"max_height" config:"max_height"`
+		// Sizes lists the allowed dimensions, an empty list allows any within the limits
+		Sizes []SizeConf `yaml:"sizes"`
+		// Presets are requested by the preset:{name} option instead of the dimensions, Sizes allow them too
+		Presets []PresetConf `yaml:"presets"`
+	}
+
+	SizeConf struct {
+		Width  int `yaml:"width"`
+		Height int `yaml:"height"`
+	}
+
+	PresetConf struct {
+		Name   string `yaml:"name"`
+		Width  int    `yaml:"width"`
+		Height int    `yaml:"height"`
+	}
+
+	// NegativeCacheConf keeps the failed loads of the urls, a zero TTL disables it
+	NegativeCacheConf struct {
+		TTL        time.Duration `yaml:"ttl" config:"negative_cache_ttl"`
+		MaxEntries int           `yaml:"max_entries" config:"negative_cache_max_entries"`
+	}
+
+	// StaleConf allows serving the expired previews, a zero window disables the mode
+	StaleConf struct {
+		// WhileRevalidate serves the expired preview at once and refreshes it in the background
+		WhileRevalidate time.Duration `yaml:"while_revalidate" config:"stale_while_revalidate"`
+		// IfError serves the expired preview when the refresh fails
+		IfError time.Duration `yaml:"if_error" config:"stale_if_error"`
+	}
+
+	EncoderConf struct {
+		Quality         int  `yaml:"quality" config:"quality"`
+		MinQuality      int  `yaml:"min_quality" config:"min_quality"`
+		MaxQuality      int  `yaml:"max_quality" config:"max_quality"`
+		JPEGProgressive bool `yaml:"jpeg_progressive" config:"jpeg_progressive"`
+	}
+
+	LoaderConf struct {
+		DefaultScheme   string     `yaml:"default_scheme" config:"default_scheme"`
+		SchemeFallback  bool       `yaml:"scheme_fallback" config:"scheme_fallback"`
+		TLS             TLSConf    `yaml:"tls"`
+		Access          AccessConf `yaml:"access"`
+		MaxBodyBytes    int64      `yaml:"max_body_bytes" config:"max_body_bytes"`
+		MaxSourcePixels int64      `yaml:"max_source_pixels" config:"max_source_pixels"`
+		// DefaultTTL applies when the origin does not tell how long the image is fresh
+		DefaultTTL time.Duration `yaml:"default_ttl" config:"default_ttl"`
+		MaxTTL     time.Duration `yaml:"max_ttl" config:"max_ttl"`
+		Retry      RetryConf     `yaml:"retry"`
+		Breaker    BreakerConf   `yaml:"breaker"`
+		Headers    HeadersConf   `yaml:"headers"`
+		File       FileConf      `yaml:"file"`
+		S3         S3Conf        `yaml:"s3"`
+	}
+
+	// FileConf serves the images of the local directory by file://{path} urls, an empty root disables it
+	FileConf struct {
+		Root string `yaml:"root" config:"file_root"`
+	}
+
+	// S3Conf serves the objects of the S3 compatible store by s3://{bucket}/{key} urls,
+	// an empty endpoint disables it and empty keys make the requests anonymous
+	S3Conf struct {
+		Endpoint     string `yaml:"endpoint" config:"s3_endpoint"`
+		Region       string `yaml:"region" config:"s3_region"`
+		AccessKey    string `yaml:"access_key" config:"s3_access_key"`
+		SecretKey    string `yaml:"secret_key" config:"s3_secret_key"`
+		SessionToken string `yaml:"session_token" config:"s3_session_token"`
+		// PathStyle puts the bucket into the path instead of the host name, as MinIO expects
+		PathStyle bool `yaml:"path_style" config:"s3_path_style"`
+	}
+
+	// HeadersConf is the policy of forwarding the client headers to the origins,
+	// the hop-by-hop and conditional headers are never forwarded
+	HeadersConf struct {
+		// Allow lists the forwarded headers, an empty list allows all of them but denied
+		Allow []string `yaml:"allow"`
+		Deny  []string `yaml:"deny"`
+		// Rename maps the client header names to the ones sent to the origin
+		Rename map[string]string `yaml:"rename"`
+		// Inject sets the static headers replacing the client ones
+		Inject map[string]string `yaml:"inject"`
+		// ForwardedFor appends the client address to X-Forwarded-For
+		ForwardedFor bool `yaml:"forwarded_for" config:"forwarded_for"`
+		// Via is the pseudonym added to Via, empty one leaves the header as is
+		Via string `yaml:"via" config:"via"`
+	}
+
+	// RetryConf repeats the requests failed with a timeout, a connection error or a 5xx status
+	RetryConf struct {
+		// Attempts is the total number of the requests, the values below 2 disable the retries
+		Attempts  int           `yaml:"attempts" config:"retry_attempts"`
+		BaseDelay time.Duration `yaml:"base_delay" config:"retry_base_delay"`
+		MaxDelay  time.Duration `yaml:"max_delay" config:"retry_max_delay"`
+	}
+
+	// BreakerConf stops requesting the host after the failures in a row, a zero threshold disables it
+	BreakerConf struct {
+		FailureThreshold int           `yaml:"failure_threshold" config:"breaker_failure_threshold"`
+		OpenTimeout      time.Duration `yaml:"open_timeout" config:"breaker_open_timeout"`
+	}
+
+	AccessConf struct {
+		AllowHosts []string `yaml:"allow_hosts"`
+		DenyHosts  []string `yaml:"deny_hosts"`
+		AllowCIDRs []string `yaml:"allow_cidrs"`
+		DenyCIDRs  []string `yaml:"deny_cidrs"`
+		AllowPorts []int    `yaml:"allow_ports"`
+		DenyPorts  []int    `yaml:"deny_ports"`
+	}
+
+	TLSConf struct {
+		CAFile             string `yaml:"ca_file" config:"tls_ca_file"`
+		MinVersion         string `yaml:"min_version" config:"tls_min_version"`
+		InsecureSkipVerify bool   `yaml:"insecure_skip_verify" config:"tls_insecure_skip_verify"`
 	}
 
 	LoggerConf struct {
@@ -35,10 +228,96 @@ type (
 	}
 )
 
+// DefaultDenyCIDRs are the loopback, private, link-local and other special purpose networks
+// which must not be reachable through the previewer.
+var DefaultDenyCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// DefaultDenyHeaders carry the credentials of the clients
+var DefaultDenyHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Real-Ip",
+}
+
 func NewConfig(configFile string) (*Config, error) {
 	cfg := Config{
 		Server: ServerConf{
 			BindAddress: ":8080",
+			HTTPCache: HTTPCacheConf{
+				MaxAge:     24 * time.Hour,
+				Directives: "public",
+			},
+			Origins: OriginsConf{
+				Raw: true,
+			},
+		},
+		Previewer: PreviewerConf{
+			Loader: LoaderConf{
+				DefaultScheme: "http",
+				TLS: TLSConf{
+					MinVersion: "1.2",
+				},
+				Access: AccessConf{
+					DenyCIDRs: DefaultDenyCIDRs,
+				},
+				MaxBodyBytes:    20 << 20,
+				MaxSourcePixels: 50_000_000,
+				DefaultTTL:      time.Hour,
+				MaxTTL:          7 * 24 * time.Hour,
+				Retry: RetryConf{
+					Attempts:  3,
+					BaseDelay: 100 * time.Millisecond,
+					MaxDelay:  time.Second,
+				},
+				Breaker: BreakerConf{
+					FailureThreshold: 5,
+					OpenTimeout:      30 * time.Second,
+				},
+				Headers: HeadersConf{
+					Deny:         DefaultDenyHeaders,
+					ForwardedFor: true,
+					Via:          "previewer",
+				},
+				S3: S3Conf{
+					Region: "us-east-1",
+				},
+			},
+			Encoder: EncoderConf{
+				Quality:         80,
+				MinQuality:      10,
+				MaxQuality:      95,
+				JPEGProgressive: true,
+			},
+			Stale: StaleConf{
+				WhileRevalidate: time.Minute,
+				IfError:         24 * time.Hour,
+			},
+			NegativeCache: NegativeCacheConf{
+				TTL:        30 * time.Second,
+				MaxEntries: 10000,
+			},
+			Resizer: ResizerConf{
+				MaxWidth:  4096,
+				MaxHeight: 4096,
+			},
 		},
 	}
 
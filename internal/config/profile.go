@@ -0,0 +1,73 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Profile returns the settings of the profile merged over the default ones
+func (c PreviewerConf) Profile(profile ProfileConf) PreviewerConf {
+	merged := c
+	merged.Profiles = nil
+
+	merge := func(dst, src interface{}, key string) {
+		keys, set := lookup(profile.keys, key)
+		override(reflect.ValueOf(dst).Elem(), reflect.ValueOf(src), set, keys)
+	}
+
+	merge(&merged.RequestTimeout, profile.RequestTimeout, "request_timeout")
+	merge(&merged.Loader, profile.Loader, "loader")
+	merge(&merged.Resizer, profile.Resizer, "resizer")
+	merge(&merged.Encoder, profile.Encoder, "encoder")
+	merge(&merged.Stale, profile.Stale, "stale")
+	merge(&merged.NegativeCache, profile.NegativeCache, "negative_cache")
+
+	return merged
+}
+
+// UnmarshalYAML keeps the keys given in the file, so that false or an empty string can override the default
+func (p *ProfileConf) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ProfileConf
+	if err := unmarshal((*plain)(p)); err != nil {
+		return err
+	}
+
+	return unmarshal(&p.keys)
+}
+
+// override sets the values given in the file, or the non-zero ones for the profiles built in code,
+// the structs are merged field by field. An empty list or map given explicitly replaces the default one.
+func override(dst, src reflect.Value, set bool, keys interface{}) {
+	switch src.Kind() {
+	case reflect.Struct:
+		for i := 0; i < src.NumField(); i++ {
+			name := strings.Split(src.Type().Field(i).Tag.Get("yaml"), ",")[0]
+			if name == "" {
+				name = strings.ToLower(src.Type().Field(i).Name)
+			}
+
+			fieldKeys, fieldSet := lookup(keys, name)
+			override(dst.Field(i), src.Field(i), fieldSet, fieldKeys)
+		}
+	case reflect.Slice, reflect.Map:
+		if set || !src.IsNil() {
+			dst.Set(src)
+		}
+	default:
+		if set || !src.IsZero() {
+			dst.Set(src)
+		}
+	}
+}
+
+// lookup returns the value of the key of the yaml mapping and whether it is given
+func lookup(keys interface{}, key string) (interface{}, bool) {
+	mapping, ok := keys.(map[interface{}]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	value, ok := mapping[key]
+
+	return value, ok
+}
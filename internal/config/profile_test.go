@@ -0,0 +1,111 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfile(t *testing.T) {
+	base := PreviewerConf{
+		RequestTimeout: time.Second,
+		CacheSize:      10,
+		Loader: LoaderConf{
+			DefaultScheme: "https",
+			TLS:           TLSConf{MinVersion: "1.2"},
+			Access:        AccessConf{DenyCIDRs: []string{"10.0.0.0/8"}},
+			DefaultTTL:    time.Hour,
+			Headers: HeadersConf{
+				Deny:   []string{"Cookie"},
+				Inject: map[string]string{"X-Client": "previewer"},
+			},
+		},
+		Encoder: EncoderConf{Quality: 80, MaxQuality: 95},
+		Stale:   StaleConf{WhileRevalidate: time.Minute, IfError: time.Hour},
+		Profiles: []ProfileConf{
+			{Name: "catalog"},
+		},
+	}
+
+	t.Run("empty profile inherits everything", func(t *testing.T) {
+		merged := base.Profile(ProfileConf{Name: "empty"})
+
+		expected := base
+		expected.Profiles = nil
+		require.Equal(t, expected, merged)
+	})
+
+	t.Run("overrides", func(t *testing.T) {
+		merged := base.Profile(ProfileConf{
+			RequestTimeout: 5 * time.Second,
+			Loader: LoaderConf{
+				TLS:        TLSConf{CAFile: "/etc/ca.pem"},
+				Access:     AccessConf{DenyCIDRs: []string{}},
+				DefaultTTL: time.Minute,
+				Headers: HeadersConf{
+					Inject: map[string]string{"Authorization": "Bearer token"},
+				},
+			},
+			Resizer: ResizerConf{MaxWidth: 1000},
+			Encoder: EncoderConf{Quality: 60},
+			Stale:   StaleConf{IfError: 24 * time.Hour},
+		})
+
+		require.Equal(t, 5*time.Second, merged.RequestTimeout)
+		require.Equal(t, 10, merged.CacheSize)
+		require.Nil(t, merged.Profiles)
+
+		require.Equal(t, "https", merged.Loader.DefaultScheme)
+		require.Equal(t, TLSConf{MinVersion: "1.2", CAFile: "/etc/ca.pem"}, merged.Loader.TLS)
+		require.Empty(t, merged.Loader.Access.DenyCIDRs)
+		require.Equal(t, time.Minute, merged.Loader.DefaultTTL)
+		require.Equal(t, []string{"Cookie"}, merged.Loader.Headers.Deny)
+		require.Equal(t, map[string]string{"Authorization": "Bearer token"}, merged.Loader.Headers.Inject)
+
+		require.Equal(t, ResizerConf{MaxWidth: 1000}, merged.Resizer)
+		require.Equal(t, EncoderConf{Quality: 60, MaxQuality: 95}, merged.Encoder)
+		require.Equal(t, StaleConf{WhileRevalidate: time.Minute, IfError: 24 * time.Hour}, merged.Stale)
+
+		// the default settings are left intact
+		require.Equal(t, time.Hour, base.Loader.DefaultTTL)
+		require.Equal(t, []string{"10.0.0.0/8"}, base.Loader.Access.DenyCIDRs)
+	})
+
+	t.Run("zero values of the file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(`
+previewer:
+  loader:
+    headers:
+      via: previewer
+  profiles:
+    - name: partner
+      hosts: [partner.example.com]
+      loader:
+        headers:
+          forwarded_for: false
+          via: ""
+      encoder:
+        jpeg_progressive: false
+`), 0o600))
+
+		cfg, err := NewConfig(path)
+		require.NoError(t, err)
+		require.True(t, cfg.Previewer.Loader.Headers.ForwardedFor)
+		require.True(t, cfg.Previewer.Encoder.JPEGProgressive)
+
+		merged := cfg.Previewer.Profile(cfg.Previewer.Profiles[0])
+
+		require.False(t, merged.Loader.Headers.ForwardedFor)
+		require.Empty(t, merged.Loader.Headers.Via)
+		require.False(t, merged.Encoder.JPEGProgressive)
+
+		// the settings missing in the file are inherited
+		require.Equal(t, cfg.Previewer.Encoder.Quality, merged.Encoder.Quality)
+		require.Equal(t, cfg.Previewer.Loader.DefaultTTL, merged.Loader.DefaultTTL)
+		require.Equal(t, "previewer", cfg.Previewer.Loader.Headers.Via)
+	})
+}
@@ -2,115 +2,520 @@ package internalcache
 
 import (
 	"container/list"
+	"context"
 	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"image"
-	"image/jpeg"
+	"io"
+	"io/fs"
+	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/alexandr-lakeev/otus-final-project/internal/app"
 )
 
+const IndexFileName = "index.json"
+
+// IndexFlushDelay gathers the changes of the index into one write, the index is also written on Close
+const IndexFlushDelay = time.Second
+
+// LruCache keeps the images on disk and the index in memory.
+// The lock guards the index only, the image files are read, written and removed outside of it.
+// The file of a key is written and indexed under the lock of the key, its evicted file is removed under it too.
 type LruCache struct {
 	capacity int
+	maxBytes int64
+	size     int64
 	queue    *list.List
 	items    map[string]*list.Element
 	dir      string
 	lock     sync.Mutex
+	version  uint64
+	// flushTimer is set while the index changes wait to be written
+	flushTimer *time.Timer
+
+	indexLock    sync.Mutex
+	savedVersion uint64
+
+	keyLocks [256]sync.Mutex
 }
 
 type CacheItem struct {
-	Key    string
-	Url    string
-	Width  int
-	Height int
-	Path   string
+	Key         string    `json:"key"`
+	Url         string    `json:"url"`
+	Variant     string    `json:"variant"`
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	LastAccess  time.Time `json:"last_access"`
+
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"last_modified"`
+
+	OriginETag         string    `json:"origin_etag"`
+	OriginLastModified string    `json:"origin_last_modified"`
+	Expires            time.Time `json:"expires"`
+	MustRevalidate     bool      `json:"must_revalidate"`
 }
 
-func NewCache(capacity int, dir string) app.Cache {
-	return &LruCache{
+// NewCache creates a cache limited by the number of images and by their total size on disk.
+// A non-positive limit disables it.
+func NewCache(capacity int, maxBytes int64, dir string) (*LruCache, error) {
+	c := &LruCache{
 		capacity: capacity,
+		maxBytes: maxBytes,
 		queue:    list.New(),
 		items:    make(map[string]*list.Element),
 		dir:      dir,
 	}
-}
 
-func (c *LruCache) Set(url string, width, height int, img image.Image) error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	if err := c.load(); err != nil {
+		return nil, err
+	}
 
-	key := c.getKey(url, width, height)
-	path, err := c.createPath(c.dir, key)
-	if err != nil {
+	return c, nil
+}
+
+func (c *LruCache) Set(ctx context.Context, url string, variant app.Variant, img *app.EncodedImage) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	listItem, exists := c.items[key]
+	key := c.getKey(url, variant)
 
-	if !exists {
-		if c.queue.Len() == c.capacity {
-			if err := c.delete(c.queue.Back()); err != nil {
-				return err
-			}
+	itemSize := int64(len(img.Data))
+	if c.maxBytes > 0 && itemSize > c.maxBytes {
+		// the previous image of the key is outdated by this one
+		if err := c.remove(key); err != nil {
+			return err
 		}
-	} else {
-		c.queue.Remove(listItem)
+
+		return app.ErrTooLargeForCache
 	}
 
-	err = c.saveToFile(path, img)
+	path, err := c.createPath(key)
 	if err != nil {
 		return err
 	}
 
+	tmpPath, err := c.saveToTempFile(path, img.Data)
+	if err != nil {
+		return err
+	}
+
+	keyLock := c.keyLock(key)
+	keyLock.Lock()
+
+	// the file appears under its path atomically, so readers never see a partial write
+	if err := os.Rename(tmpPath, path); err != nil {
+		keyLock.Unlock()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	c.lock.Lock()
+
+	if listItem, exists := c.items[key]; exists {
+		c.queue.Remove(listItem)
+		delete(c.items, key)
+		c.size -= listItem.Value.(*CacheItem).Size
+	}
+
+	var evicted []*CacheItem
+	for c.queue.Len() > 0 && !c.fits(itemSize) {
+		evicted = append(evicted, c.delete(c.queue.Back()))
+	}
+
 	c.items[key] = c.queue.PushFront(&CacheItem{
-		Key:    key,
-		Url:    url,
-		Width:  width,
-		Height: height,
-		Path:   path,
+		Key:         key,
+		Url:         url,
+		Variant:     variant.String(),
+		Path:        path,
+		Size:        itemSize,
+		ContentType: img.ContentType,
+		LastAccess:  time.Now(),
+
+		ETag:         img.ETag,
+		LastModified: img.LastModified,
+
+		OriginETag:         img.Origin.ETag,
+		OriginLastModified: img.Origin.LastModified,
+		Expires:            img.Origin.Expires,
+		MustRevalidate:     img.Origin.MustRevalidate,
 	})
+	c.size += itemSize
+	c.version++
+	c.scheduleFlush()
+
+	c.lock.Unlock()
+	keyLock.Unlock()
+
+	return c.removeFiles(evicted)
+}
+
+func (c *LruCache) Get(ctx context.Context, url string, variant app.Variant) (*app.EncodedImage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	key := c.getKey(url, variant)
+
+	c.lock.Lock()
+
+	listItem, exists := c.items[key]
+	if !exists {
+		c.lock.Unlock()
+		return nil, app.ErrNotFoundInCache
+	}
+
+	cacheItem := listItem.Value.(*CacheItem)
+	cacheItem.LastAccess = time.Now()
+	c.queue.MoveToFront(listItem)
+	c.version++
+
+	path, contentType := cacheItem.Path, cacheItem.ContentType
+	etag, lastModified := cacheItem.ETag, cacheItem.LastModified
+	origin := app.Origin{
+		ETag:           cacheItem.OriginETag,
+		LastModified:   cacheItem.OriginLastModified,
+		Expires:        cacheItem.Expires,
+		MustRevalidate: cacheItem.MustRevalidate,
+	}
+
+	c.lock.Unlock()
+
+	data, err := c.readFromFile(path)
+	if os.IsNotExist(err) {
+		// evicted while being read
+		c.forget(key, listItem)
+		return nil, app.ErrNotFoundInCache
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the adopted files have no validator, they are also expired and get reloaded
+	if etag == "" {
+		etag = app.NewETag(data)
+	}
+
+	return &app.EncodedImage{
+		Data:         data,
+		ContentType:  contentType,
+		ETag:         etag,
+		LastModified: lastModified,
+		Origin:       origin,
+	}, nil
+}
+
+// Close flushes the index, so the access order changed by Get survives a restart.
+func (c *LruCache) Close() error {
+	c.lock.Lock()
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+	}
+
+	return c.flush()
+}
+
+// scheduleFlush writes the index after the delay, must be called under the lock.
+func (c *LruCache) scheduleFlush() {
+	if c.flushTimer != nil {
+		return
+	}
+
+	c.flushTimer = time.AfterFunc(IndexFlushDelay, func() {
+		c.lock.Lock()
+		// a failed write is repeated by the next flush, Close reports it
+		_ = c.flush()
+	})
+}
+
+// flush writes the index, must be called under the lock which it releases before writing.
+func (c *LruCache) flush() error {
+	c.flushTimer = nil
+	cacheItems, version := c.snapshot()
+	c.lock.Unlock()
+
+	return c.saveIndex(cacheItems, version)
+}
+
+// delete drops the item from the index and returns it, its file is removed outside of the lock.
+func (c *LruCache) delete(item *list.Element) *CacheItem {
+	c.queue.Remove(item)
+
+	cacheItem := item.Value.(*CacheItem)
+	delete(c.items, cacheItem.Key)
+	c.size -= cacheItem.Size
+	c.version++
+
+	return cacheItem
+}
+
+// remove drops the item of the key from the index and removes its file.
+func (c *LruCache) remove(key string) error {
+	c.lock.Lock()
+	listItem, exists := c.items[key]
+	if !exists {
+		c.lock.Unlock()
+		return nil
+	}
+
+	evicted := c.delete(listItem)
+	c.scheduleFlush()
+	c.lock.Unlock()
+
+	return c.removeFiles([]*CacheItem{evicted})
+}
+
+// removeFiles removes the files of the evicted items, unless their keys have been written again in the meantime.
+func (c *LruCache) removeFiles(evicted []*CacheItem) error {
+	var firstErr error
+	for _, cacheItem := range evicted {
+		if err := c.removeFile(cacheItem); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (c *LruCache) removeFile(cacheItem *CacheItem) error {
+	keyLock := c.keyLock(cacheItem.Key)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	c.lock.Lock()
+	_, rewritten := c.items[cacheItem.Key]
+	c.lock.Unlock()
+
+	if rewritten {
+		return nil
+	}
+
+	if err := os.Remove(cacheItem.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 
 	return nil
 }
 
-func (c *LruCache) Get(url string, width, height int) (image.Image, error) {
+// keyLock returns the lock of the key, the keys share 256 locks by their first byte.
+func (c *LruCache) keyLock(key string) *sync.Mutex {
+	b, _ := hex.DecodeString(key[:2])
+
+	return &c.keyLocks[b[0]]
+}
+
+// forget drops the item whose file has disappeared, unless it has been replaced in the meantime.
+func (c *LruCache) forget(key string, item *list.Element) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	key := c.getKey(url, width, height)
-	listItem, exists := c.items[key]
+	if c.items[key] != item {
+		return
+	}
+
+	c.queue.Remove(item)
+	delete(c.items, key)
+	c.size -= item.Value.(*CacheItem).Size
+	c.version++
+}
 
-	if exists {
-		path := listItem.Value.(*CacheItem).Path
-		c.queue.MoveToFront(listItem)
+// fits reports whether one more item of the given size can be added without exceeding the limits.
+func (c *LruCache) fits(itemSize int64) bool {
+	if c.capacity > 0 && c.queue.Len() >= c.capacity {
+		return false
+	}
+
+	return c.maxBytes <= 0 || c.size+itemSize <= c.maxBytes
+}
+
+func (c *LruCache) overflows() bool {
+	return (c.capacity > 0 && c.queue.Len() > c.capacity) || (c.maxBytes > 0 && c.size > c.maxBytes)
+}
+
+// load restores the items from the index file and reconciles it with the files on disk:
+// index entries without a file are dropped, cache files without an entry are adopted,
+// anything else found in the cache tree is deleted.
+func (c *LruCache) load() error {
+	if err := os.MkdirAll(c.dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	indexed, err := c.readIndex()
+	if err != nil {
+		return err
+	}
+
+	found, err := c.scanFiles(indexed)
+	if err != nil {
+		return err
+	}
+
+	cacheItems := make([]*CacheItem, 0, len(found))
+	for _, cacheItem := range found {
+		cacheItems = append(cacheItems, cacheItem)
+	}
+
+	sort.SliceStable(cacheItems, func(i, j int) bool {
+		return cacheItems[i].LastAccess.After(cacheItems[j].LastAccess)
+	})
+
+	for _, cacheItem := range cacheItems {
+		c.items[cacheItem.Key] = c.queue.PushBack(cacheItem)
+		c.size += cacheItem.Size
+	}
+
+	var evicted []*CacheItem
+	for c.queue.Len() > 0 && c.overflows() {
+		evicted = append(evicted, c.delete(c.queue.Back()))
+	}
+	if err := c.removeFiles(evicted); err != nil {
+		return err
+	}
+
+	return c.saveIndex(c.snapshot())
+}
+
+func (c *LruCache) readIndex() (map[string]*CacheItem, error) {
+	indexed := make(map[string]*CacheItem)
+
+	data, err := os.ReadFile(c.indexPath())
+	if os.IsNotExist(err) {
+		return indexed, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cacheItems []*CacheItem
+	if err := json.Unmarshal(data, &cacheItems); err != nil {
+		// a broken index is not fatal, the files will be adopted by the scan
+		return indexed, nil
+	}
+
+	for _, cacheItem := range cacheItems {
+		indexed[cacheItem.Key] = cacheItem
+	}
+
+	return indexed, nil
+}
+
+func (c *LruCache) scanFiles(indexed map[string]*CacheItem) (map[string]*CacheItem, error) {
+	found := make(map[string]*CacheItem)
 
-		img, err := c.readFromFile(path)
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		// only the key tree belongs to the cache, the rest of the dir is left untouched
+		if !entry.IsDir() || !isKeyPart(entry.Name()) {
+			continue
+		}
+
+		root := filepath.Join(c.dir, entry.Name())
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+
+			key := d.Name()
+			if !isKey(key) || path != c.keyPath(key) {
+				return os.Remove(path)
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			cacheItem, ok := indexed[key]
+			if !ok {
+				contentType, err := c.detectContentType(path)
+				if err != nil {
+					return err
+				}
+
+				cacheItem = &CacheItem{
+					Key:          key,
+					ContentType:  contentType,
+					LastAccess:   info.ModTime(),
+					LastModified: info.ModTime(),
+				}
+			}
+			cacheItem.Path = path
+			cacheItem.Size = info.Size()
+			found[key] = cacheItem
+
+			return nil
+		})
 		if err != nil {
 			return nil, err
 		}
+	}
+
+	return found, nil
+}
 
-		return img, nil
+// snapshot copies the index in the LRU order, must be called under the lock.
+func (c *LruCache) snapshot() ([]CacheItem, uint64) {
+	c.version++
+
+	cacheItems := make([]CacheItem, 0, c.queue.Len())
+	for e := c.queue.Front(); e != nil; e = e.Next() {
+		cacheItems = append(cacheItems, *e.Value.(*CacheItem))
 	}
 
-	return nil, app.ErrNotFoundInCache
+	return cacheItems, c.version
 }
 
-func (c *LruCache) delete(item *list.Element) error {
-	c.queue.Remove(item)
+func (c *LruCache) saveIndex(cacheItems []CacheItem, version uint64) error {
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
 
-	cacheItem := item.Value.(*CacheItem)
-	delete(c.items, cacheItem.Key)
+	// a newer snapshot has already been written
+	if version <= c.savedVersion {
+		return nil
+	}
 
-	return os.Remove(cacheItem.Path)
+	data, err := json.Marshal(cacheItems)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := c.indexPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, c.indexPath()); err != nil {
+		return err
+	}
+
+	c.savedVersion = version
+
+	return nil
 }
 
-func (c *LruCache) getKey(url string, width, height int) string {
-	return c.getHash(url + strconv.Itoa(width) + strconv.Itoa(height))
+func (c *LruCache) indexPath() string {
+	return filepath.Join(c.dir, IndexFileName)
+}
+
+func (c *LruCache) getKey(url string, variant app.Variant) string {
+	return c.getHash(url + variant.String())
 }
 
 func (i *LruCache) getHash(key string) string {
@@ -119,41 +524,72 @@ func (i *LruCache) getHash(key string) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-func (i *LruCache) createPath(dir, key string) (string, error) {
-	pathParts := append([]string{dir}, strings.Split(key, "")...)
-	path := filepath.Join(pathParts...)
+func (i *LruCache) keyPath(key string) string {
+	pathParts := append([]string{i.dir}, strings.Split(key, "")...)
 
-	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+	return filepath.Join(append(pathParts, key)...)
+}
+
+func (i *LruCache) createPath(key string) (string, error) {
+	path := i.keyPath(key)
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
 		return "", err
 	}
 
-	return filepath.Join(path, key), nil
+	return path, nil
 }
 
-func (c *LruCache) saveToFile(path string, img image.Image) error {
-	file, err := os.Create(path)
+func (c *LruCache) saveToTempFile(path string, data []byte) (string, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer file.Close()
 
-	if err = jpeg.Encode(file, img, nil); err != nil {
-		return err
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
 	}
 
-	return nil
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+func (c *LruCache) readFromFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
 }
 
-func (c *LruCache) readFromFile(path string) (image.Image, error) {
+func (c *LruCache) detectContentType(path string) (string, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	defer file.Close()
 
-	img, err := jpeg.Decode(file)
-	if err != nil {
-		return nil, err
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
 	}
 
-	return img, nil
+	return http.DetectContentType(head[:n]), nil
+}
+
+func isKey(name string) bool {
+	if len(name) != sha1.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(name)
+
+	return err == nil && strings.ToLower(name) == name
+}
+
+func isKeyPart(name string) bool {
+	return len(name) == 1 && strings.Contains("0123456789abcdef", name)
 }
@@ -1,131 +1,501 @@
 package internalcache
 
 import (
+	"bytes"
+	"context"
 	"image"
+	"image/jpeg"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/alexandr-lakeev/otus-final-project/internal/app"
 	"github.com/stretchr/testify/require"
 )
 
 func TestCache(t *testing.T) {
-	img100x100 := image.NewNRGBA(image.Rect(0, 0, 100, 100))
-	img200x200 := image.NewNRGBA(image.Rect(0, 0, 200, 200))
-	img300x300 := image.NewNRGBA(image.Rect(0, 0, 300, 300))
-	img400x400 := image.NewNRGBA(image.Rect(0, 0, 400, 400))
-	img500x500 := image.NewNRGBA(image.Rect(0, 0, 500, 500))
-	img600x600 := image.NewNRGBA(image.Rect(0, 0, 600, 600))
+	img100x100 := encodeImage(t, 100, 100)
+	img200x200 := encodeImage(t, 200, 200)
+	img300x300 := encodeImage(t, 300, 300)
+	img400x400 := encodeImage(t, 400, 400)
+	img500x500 := encodeImage(t, 500, 500)
+	img600x600 := encodeImage(t, 600, 600)
 
 	errNotFound := app.ErrNotFoundInCache
 
 	t.Run("empty cache", func(t *testing.T) {
-		cache := NewCache(5, os.TempDir())
+		cache, err := NewCache(5, 0, t.TempDir())
+		require.NoError(t, err)
 
-		_, err := cache.Get("www.img.ru/some-img.jpg", 100, 100)
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
 
 		require.ErrorIs(t, err, errNotFound)
 	})
 
 	t.Run("simple caching", func(t *testing.T) {
-		cache := NewCache(5, os.TempDir())
+		cache, err := NewCache(5, 0, t.TempDir())
+		require.NoError(t, err)
 
-		err := cache.Set("www.img.ru/some-img.jpg", 100, 100, img100x100)
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
 		require.NoError(t, err)
 
-		err = cache.Set("www.img.ru/some-img.jpg", 200, 200, img200x200)
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(200, 200), img200x200)
 		require.NoError(t, err)
 
-		img100x100Cached, err := cache.Get("www.img.ru/some-img.jpg", 100, 100)
+		img100x100Cached, err := cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
 
 		require.NoError(t, err)
-		require.Equal(t, 100, img100x100Cached.Bounds().Max.X)
-		require.Equal(t, 100, img100x100Cached.Bounds().Max.Y)
+		require.Equal(t, 100, decodeImage(t, img100x100Cached).Bounds().Max.X)
+		require.Equal(t, 100, decodeImage(t, img100x100Cached).Bounds().Max.Y)
 
-		img200x200Cached, err := cache.Get("www.img.ru/some-img.jpg", 200, 200)
+		img200x200Cached, err := cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(200, 200))
 
 		require.NoError(t, err)
-		require.Equal(t, 200, img200x200Cached.Bounds().Max.X)
-		require.Equal(t, 200, img200x200Cached.Bounds().Max.Y)
+		require.Equal(t, 200, decodeImage(t, img200x200Cached).Bounds().Max.X)
+		require.Equal(t, 200, decodeImage(t, img200x200Cached).Bounds().Max.Y)
 
-		_, err = cache.Get("www.img.ru/some-img.jpg", 300, 300)
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(300, 300))
 
 		require.ErrorIs(t, err, errNotFound)
 	})
 
 	t.Run("first added is removing", func(t *testing.T) {
-		cache := NewCache(5, os.TempDir())
+		cache, err := NewCache(5, 0, t.TempDir())
+		require.NoError(t, err)
 
-		err := cache.Set("www.img.ru/some-img.jpg", 100, 100, img100x100)
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
 		require.NoError(t, err)
 
-		err = cache.Set("www.img.ru/some-img.jpg", 200, 200, img200x200)
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(200, 200), img200x200)
 		require.NoError(t, err)
 
-		err = cache.Set("www.img.ru/some-img.jpg", 300, 300, img300x300)
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(300, 300), img300x300)
 		require.NoError(t, err)
 
-		err = cache.Set("www.img.ru/some-img.jpg", 400, 400, img400x400)
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(400, 400), img400x400)
 		require.NoError(t, err)
 
-		err = cache.Set("www.img.ru/some-img.jpg", 500, 500, img500x500)
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(500, 500), img500x500)
 		require.NoError(t, err)
 
-		err = cache.Set("www.img.ru/some-img.jpg", 600, 600, img600x600)
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(600, 600), img600x600)
 		require.NoError(t, err)
 
-		img600x600Cached, err := cache.Get("www.img.ru/some-img.jpg", 600, 600)
+		img600x600Cached, err := cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(600, 600))
 
 		require.NoError(t, err)
-		require.Equal(t, 600, img600x600Cached.Bounds().Max.X)
-		require.Equal(t, 600, img600x600Cached.Bounds().Max.Y)
+		require.Equal(t, 600, decodeImage(t, img600x600Cached).Bounds().Max.X)
+		require.Equal(t, 600, decodeImage(t, img600x600Cached).Bounds().Max.Y)
 
-		_, err = cache.Get("www.img.ru/some-img.jpg", 100, 100)
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
 
 		require.ErrorIs(t, err, errNotFound)
 	})
 
 	t.Run("first touched is removing", func(t *testing.T) {
-		cache := NewCache(5, os.TempDir())
+		cache, err := NewCache(5, 0, t.TempDir())
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(200, 200), img200x200)
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(300, 300), img300x300)
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(400, 400), img400x400)
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(500, 500), img500x500)
+		require.NoError(t, err)
+
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(500, 500))
+		require.NoError(t, err)
+
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(400, 400))
+		require.NoError(t, err)
+
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(300, 300))
+		require.NoError(t, err)
+
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(200, 200))
+		require.NoError(t, err)
+
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(600, 600), img600x600)
+		require.NoError(t, err)
+
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(600, 600))
+		require.NoError(t, err)
+
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(500, 500))
+
+		require.ErrorIs(t, err, errNotFound)
+	})
+
+	t.Run("evicted by size", func(t *testing.T) {
+		itemSize := int64(len(img100x100.Data))
+
+		cache, err := NewCache(5, 2*itemSize, t.TempDir())
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/first-img.jpg", fill(100, 100), img100x100)
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/second-img.jpg", fill(100, 100), img100x100)
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/third-img.jpg", fill(100, 100), img100x100)
+		require.NoError(t, err)
+
+		_, err = cache.Get(context.Background(), "www.img.ru/first-img.jpg", fill(100, 100))
+		require.ErrorIs(t, err, errNotFound)
+
+		_, err = cache.Get(context.Background(), "www.img.ru/second-img.jpg", fill(100, 100))
+		require.NoError(t, err)
+
+		_, err = cache.Get(context.Background(), "www.img.ru/third-img.jpg", fill(100, 100))
+		require.NoError(t, err)
+
+		require.Equal(t, 2*itemSize, cache.size)
+	})
+
+	t.Run("too large for cache", func(t *testing.T) {
+		cache, err := NewCache(5, 1, t.TempDir())
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
+		require.ErrorIs(t, err, app.ErrTooLargeForCache)
+
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
+		require.ErrorIs(t, err, errNotFound)
+	})
+
+	t.Run("too large replacement removes the previous image", func(t *testing.T) {
+		cache, err := NewCache(5, int64(len(img100x100.Data)), t.TempDir())
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
+		require.NoError(t, err)
+		path := cache.keyPath(cache.getKey("www.img.ru/some-img.jpg", fill(100, 100)))
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img200x200)
+		require.ErrorIs(t, err, app.ErrTooLargeForCache)
+
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
+		require.ErrorIs(t, err, errNotFound)
+		require.NoFileExists(t, path)
+		require.Equal(t, int64(0), cache.size)
+	})
+
+	t.Run("file removed while indexed", func(t *testing.T) {
+		cache, err := NewCache(5, 0, t.TempDir())
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
+		require.NoError(t, err)
+
+		require.NoError(t, os.Remove(cache.keyPath(cache.getKey("www.img.ru/some-img.jpg", fill(100, 100)))))
+
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
+		require.ErrorIs(t, err, errNotFound)
+		require.Equal(t, 0, cache.queue.Len())
+		require.Equal(t, int64(0), cache.size)
+	})
+
+	t.Run("concurrent access", func(t *testing.T) {
+		cache, err := NewCache(3, 0, t.TempDir())
+		require.NoError(t, err)
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				for j := 0; j < 20; j++ {
+					url := "www.img.ru/" + strconv.Itoa((i+j)%5) + ".jpg"
+
+					if err := cache.Set(context.Background(), url, fill(100, 100), img100x100); err != nil {
+						t.Error(err)
+					}
+					if _, err := cache.Get(context.Background(), url, fill(100, 100)); err != nil && err != errNotFound {
+						t.Error(err)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		require.LessOrEqual(t, cache.queue.Len(), 3)
+		require.Equal(t, int64(cache.queue.Len())*int64(len(img100x100.Data)), cache.size)
+
+		// the evictions have not removed the files written again
+		for key := range cache.items {
+			require.FileExists(t, cache.keyPath(key))
+		}
+	})
+
+	t.Run("evicted file of a rewritten key is kept", func(t *testing.T) {
+		cache, err := NewCache(5, 0, t.TempDir())
+		require.NoError(t, err)
 
-		err := cache.Set("www.img.ru/some-img.jpg", 100, 100, img100x100)
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
 		require.NoError(t, err)
 
-		err = cache.Set("www.img.ru/some-img.jpg", 200, 200, img200x200)
+		key := cache.getKey("www.img.ru/some-img.jpg", fill(100, 100))
+		evicted := cache.delete(cache.items[key])
+
+		// the key is written again before the eviction removes its file
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img200x200)
+		require.NoError(t, err)
+		require.NoError(t, cache.removeFiles([]*CacheItem{evicted}))
+
+		cached, err := cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
+		require.NoError(t, err)
+		require.Equal(t, img200x200.Data, cached.Data)
+	})
+
+	t.Run("restored after restart", func(t *testing.T) {
+		dir := t.TempDir()
+
+		cache, err := NewCache(3, 0, dir)
 		require.NoError(t, err)
 
-		err = cache.Set("www.img.ru/some-img.jpg", 300, 300, img300x300)
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
 		require.NoError(t, err)
 
-		err = cache.Set("www.img.ru/some-img.jpg", 400, 400, img400x400)
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(200, 200), img200x200)
 		require.NoError(t, err)
 
-		err = cache.Set("www.img.ru/some-img.jpg", 500, 500, img500x500)
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(300, 300), img300x300)
 		require.NoError(t, err)
 
-		_, err = cache.Get("www.img.ru/some-img.jpg", 500, 500)
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
+		require.NoError(t, err)
+
+		require.NoError(t, cache.Close())
+
+		cache, err = NewCache(3, 0, dir)
 		require.NoError(t, err)
 
-		_, err = cache.Get("www.img.ru/some-img.jpg", 400, 400)
+		img100x100Cached, err := cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
 		require.NoError(t, err)
+		require.Equal(t, 100, decodeImage(t, img100x100Cached).Bounds().Max.X)
+		require.Equal(t, img100x100.ETag, img100x100Cached.ETag)
+		require.True(t, img100x100.LastModified.Equal(img100x100Cached.LastModified))
+		require.Equal(t, img100x100.Origin.ETag, img100x100Cached.Origin.ETag)
+		require.Equal(t, img100x100.Origin.LastModified, img100x100Cached.Origin.LastModified)
+		require.True(t, img100x100.Origin.Expires.Equal(img100x100Cached.Origin.Expires))
+		require.True(t, img100x100Cached.Origin.MustRevalidate)
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(400, 400), img400x400)
+		require.NoError(t, err)
+
+		// 200x200 is the least recently used one
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(200, 200))
+		require.ErrorIs(t, err, errNotFound)
 
-		_, err = cache.Get("www.img.ru/some-img.jpg", 300, 300)
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(300, 300))
 		require.NoError(t, err)
+	})
+
+	t.Run("index flushed in background", func(t *testing.T) {
+		dir := t.TempDir()
 
-		_, err = cache.Get("www.img.ru/some-img.jpg", 200, 200)
+		cache, err := NewCache(5, 0, dir)
 		require.NoError(t, err)
+		defer cache.Close()
 
-		_, err = cache.Get("www.img.ru/some-img.jpg", 100, 100)
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
 		require.NoError(t, err)
 
-		err = cache.Set("www.img.ru/some-img.jpg", 600, 600, img600x600)
+		key := cache.getKey("www.img.ru/some-img.jpg", fill(100, 100))
+		indexed := func() bool {
+			data, err := os.ReadFile(filepath.Join(dir, IndexFileName))
+			return err == nil && strings.Contains(string(data), key)
+		}
+
+		// the write does not wait for the index
+		require.False(t, indexed())
+		require.Eventually(t, indexed, 3*IndexFlushDelay, 10*time.Millisecond)
+	})
+
+	t.Run("orphan files reconciled", func(t *testing.T) {
+		dir := t.TempDir()
+
+		cache, err := NewCache(5, 0, dir)
 		require.NoError(t, err)
 
-		_, err = cache.Get("www.img.ru/some-img.jpg", 600, 600)
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
 		require.NoError(t, err)
 
-		_, err = cache.Get("www.img.ru/some-img.jpg", 500, 500)
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(200, 200), img200x200)
+		require.NoError(t, err)
+
+		// a file from a partial write and a file outside of the cache tree
+		strayPath := cache.keyPath(cache.getKey("www.img.ru/some-img.jpg", fill(100, 100))) + ".tmp"
+		require.NoError(t, os.WriteFile(strayPath, []byte("stray"), 0o644))
+
+		foreignPath := filepath.Join(dir, "foreign.txt")
+		require.NoError(t, os.WriteFile(foreignPath, []byte("foreign"), 0o644))
+		require.NoError(t, cache.Close())
+
+		// lost index
+		require.NoError(t, os.Remove(filepath.Join(dir, IndexFileName)))
+
+		cache, err = NewCache(5, 0, dir)
+		require.NoError(t, err)
+
+		adopted, err := cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
+		require.NoError(t, err)
+		require.Equal(t, "image/jpeg", adopted.ContentType)
+		require.Equal(t, img100x100.ETag, adopted.ETag)
+		require.False(t, adopted.LastModified.IsZero())
+		require.False(t, adopted.Origin.Fresh(time.Now()))
+
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(200, 200))
+		require.NoError(t, err)
+
+		require.NoFileExists(t, strayPath)
+		require.FileExists(t, foreignPath)
+	})
+
+	t.Run("missing files dropped from index", func(t *testing.T) {
+		dir := t.TempDir()
+
+		cache, err := NewCache(5, 0, dir)
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
+		require.NoError(t, err)
+
+		require.NoError(t, os.Remove(cache.keyPath(cache.getKey("www.img.ru/some-img.jpg", fill(100, 100)))))
+		require.NoError(t, cache.Close())
+
+		cache, err = NewCache(5, 0, dir)
+		require.NoError(t, err)
 
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
 		require.ErrorIs(t, err, errNotFound)
 	})
+
+	t.Run("trimmed to capacity after restart", func(t *testing.T) {
+		dir := t.TempDir()
+
+		cache, err := NewCache(3, 0, dir)
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
+		require.NoError(t, err)
+
+		time.Sleep(time.Millisecond)
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(200, 200), img200x200)
+		require.NoError(t, err)
+		require.NoError(t, cache.Close())
+
+		cache, err = NewCache(1, 0, dir)
+		require.NoError(t, err)
+
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
+		require.ErrorIs(t, err, errNotFound)
+
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(200, 200))
+		require.NoError(t, err)
+	})
+}
+
+// benchmarkEntries makes the index large enough for the work done under the lock to show up
+const benchmarkEntries = 5000
+
+func BenchmarkCacheGetParallel(b *testing.B) {
+	img := encodeImage(b, 300, 300)
+
+	cache, err := NewCache(benchmarkEntries, 0, b.TempDir())
+	require.NoError(b, err)
+
+	for i := 0; i < benchmarkEntries; i++ {
+		require.NoError(b, cache.Set(context.Background(), "www.img.ru/"+strconv.Itoa(i)+".jpg", fill(300, 300), img))
+	}
+
+	var counter int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := atomic.AddInt64(&counter, 1)
+			if _, err := cache.Get(context.Background(), "www.img.ru/"+strconv.Itoa(int(n%benchmarkEntries))+".jpg", fill(300, 300)); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func BenchmarkCacheSetParallel(b *testing.B) {
+	img := encodeImage(b, 300, 300)
+
+	cache, err := NewCache(benchmarkEntries, 0, b.TempDir())
+	require.NoError(b, err)
+
+	for i := 0; i < benchmarkEntries; i++ {
+		require.NoError(b, cache.Set(context.Background(), "www.img.ru/"+strconv.Itoa(i)+".jpg", fill(300, 300), img))
+	}
+
+	var counter int64
+
+	// the keys are twice the capacity, so the sets keep evicting
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := atomic.AddInt64(&counter, 1)
+			if err := cache.Set(context.Background(), "www.img.ru/"+strconv.Itoa(int(n%(2*benchmarkEntries)))+".jpg", fill(300, 300), img); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func fill(width, height int) app.Variant {
+	return app.Variant{Mode: app.ResizeModeFill, Width: width, Height: height}
+}
+
+func encodeImage(t testing.TB, width, height int) *app.EncodedImage {
+	t.Helper()
+
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, width, height)), nil)
+	require.NoError(t, err)
+
+	return &app.EncodedImage{
+		Data:         buf.Bytes(),
+		ContentType:  "image/jpeg",
+		ETag:         app.NewETag(buf.Bytes()),
+		LastModified: time.Now().UTC(),
+		Origin: app.Origin{
+			ETag:           `"origin"`,
+			LastModified:   time.Now().UTC().Format(http.TimeFormat),
+			Expires:        time.Now().Add(time.Hour),
+			MustRevalidate: true,
+		},
+	}
+}
+
+func decodeImage(t *testing.T, img *app.EncodedImage) image.Image {
+	t.Helper()
+
+	decoded, err := jpeg.Decode(bytes.NewReader(img.Data))
+	require.NoError(t, err)
+
+	return decoded
 }
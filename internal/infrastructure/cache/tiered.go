@@ -0,0 +1,158 @@
+package internalcache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+)
+
+// TieredCache keeps the hot images in memory in front of the disk cache.
+// New images are written to disk before they are put into memory, so the memory is only a copy and may be dropped.
+// Images found on disk are promoted to memory unless they have been replaced while read.
+type TieredCache struct {
+	maxBytes int64
+	size     int64
+	queue    *list.List
+	items    map[string]*list.Element
+	// promotions are the disk reads in progress, a write of the key makes them stale
+	promotions map[string]*promotion
+	disk       *LruCache
+	lock       sync.Mutex
+}
+
+type memoryItem struct {
+	key string
+	img *app.EncodedImage
+}
+
+type promotion struct {
+	readers int
+	stale   bool
+}
+
+func NewTieredCache(maxBytes int64, disk *LruCache) *TieredCache {
+	return &TieredCache{
+		maxBytes:   maxBytes,
+		queue:      list.New(),
+		items:      make(map[string]*list.Element),
+		promotions: make(map[string]*promotion),
+		disk:       disk,
+	}
+}
+
+func (c *TieredCache) Set(ctx context.Context, url string, variant app.Variant, img *app.EncodedImage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	key := c.disk.getKey(url, variant)
+
+	if err := c.disk.Set(ctx, url, variant, img); err != nil {
+		c.remove(key)
+		return err
+	}
+
+	if int64(len(img.Data)) > c.maxBytes {
+		c.remove(key)
+		return nil
+	}
+
+	c.put(&memoryItem{key: key, img: img})
+
+	return nil
+}
+
+func (c *TieredCache) Get(ctx context.Context, url string, variant app.Variant) (*app.EncodedImage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	key := c.disk.getKey(url, variant)
+
+	c.lock.Lock()
+	if listItem, exists := c.items[key]; exists {
+		c.queue.MoveToFront(listItem)
+		c.lock.Unlock()
+
+		return listItem.Value.(*memoryItem).img, nil
+	}
+
+	pending, exists := c.promotions[key]
+	if !exists {
+		pending = &promotion{}
+		c.promotions[key] = pending
+	}
+	pending.readers++
+	c.lock.Unlock()
+
+	img, err := c.disk.Get(ctx, url, variant)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	pending.readers--
+	if pending.readers == 0 && c.promotions[key] == pending {
+		delete(c.promotions, key)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, exists := c.items[key]; !exists && !pending.stale && int64(len(img.Data)) <= c.maxBytes {
+		c.link(&memoryItem{key: key, img: img})
+	}
+
+	return img, nil
+}
+
+func (c *TieredCache) Close() error {
+	return c.disk.Close()
+}
+
+// put replaces the item kept in memory, the promotions of its key read before the write are dropped.
+func (c *TieredCache) put(item *memoryItem) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.invalidate(item.key)
+	c.link(item)
+}
+
+func (c *TieredCache) remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.invalidate(key)
+}
+
+func (c *TieredCache) invalidate(key string) {
+	if pending, exists := c.promotions[key]; exists {
+		pending.stale = true
+		delete(c.promotions, key)
+	}
+
+	if listItem, exists := c.items[key]; exists {
+		c.unlink(listItem)
+	}
+}
+
+// link adds the item to memory, the least recently used items are dropped to make room for it, they are on disk.
+func (c *TieredCache) link(item *memoryItem) {
+	for c.queue.Len() > 0 && c.size+int64(len(item.img.Data)) > c.maxBytes {
+		c.unlink(c.queue.Back())
+	}
+
+	c.items[item.key] = c.queue.PushFront(item)
+	c.size += int64(len(item.img.Data))
+}
+
+func (c *TieredCache) unlink(listItem *list.Element) {
+	item := listItem.Value.(*memoryItem)
+
+	c.queue.Remove(listItem)
+	delete(c.items, item.key)
+	c.size -= int64(len(item.img.Data))
+}
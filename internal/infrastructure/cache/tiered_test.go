@@ -0,0 +1,144 @@
+package internalcache
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTieredCache(t *testing.T) {
+	img100x100 := encodeImage(t, 100, 100)
+	img200x200 := encodeImage(t, 200, 200)
+	img300x300 := encodeImage(t, 300, 300)
+
+	newTieredCache := func(t *testing.T, maxBytes int64) (*TieredCache, *LruCache) {
+		t.Helper()
+
+		disk, err := NewCache(10, 0, t.TempDir())
+		require.NoError(t, err)
+
+		cache := NewTieredCache(maxBytes, disk)
+		t.Cleanup(func() { cache.Close() })
+
+		return cache, disk
+	}
+
+	t.Run("new images are written through to disk", func(t *testing.T) {
+		cache, disk := newTieredCache(t, int64(len(img100x100.Data)))
+
+		err := cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
+		require.NoError(t, err)
+
+		_, exists := cache.items[disk.getKey("www.img.ru/some-img.jpg", fill(100, 100))]
+		require.True(t, exists)
+
+		stored, err := disk.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
+		require.NoError(t, err)
+		require.Equal(t, img100x100.Data, stored.Data)
+	})
+
+	t.Run("evicted images are read from disk", func(t *testing.T) {
+		cache, _ := newTieredCache(t, int64(len(img100x100.Data)+len(img200x200.Data)))
+
+		err := cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(200, 200), img200x200)
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(300, 300), img300x300)
+		require.NoError(t, err)
+		require.Equal(t, 1, cache.queue.Len())
+
+		cached, err := cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
+		require.NoError(t, err)
+		require.Equal(t, img100x100.Data, cached.Data)
+	})
+
+	t.Run("disk hit is promoted to memory", func(t *testing.T) {
+		cache, disk := newTieredCache(t, int64(len(img100x100.Data)))
+
+		err := disk.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
+		require.NoError(t, err)
+
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
+		require.NoError(t, err)
+
+		_, exists := cache.items[disk.getKey("www.img.ru/some-img.jpg", fill(100, 100))]
+		require.True(t, exists)
+	})
+
+	t.Run("failed disk write drops the image from memory", func(t *testing.T) {
+		disk, err := NewCache(10, int64(len(img100x100.Data)), t.TempDir())
+		require.NoError(t, err)
+
+		cache := NewTieredCache(int64(len(img200x200.Data)), disk)
+		defer cache.Close()
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
+		require.NoError(t, err)
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img200x200)
+		require.ErrorIs(t, err, app.ErrTooLargeForCache)
+
+		_, err = cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
+		require.ErrorIs(t, err, app.ErrNotFoundInCache)
+	})
+
+	t.Run("promotion does not replace a newer image", func(t *testing.T) {
+		cache, disk := newTieredCache(t, int64(len(img100x100.Data)+len(img200x200.Data)))
+		key := disk.getKey("www.img.ru/some-img.jpg", fill(100, 100))
+
+		err := disk.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img100x100)
+		require.NoError(t, err)
+
+		// the image is replaced while a promotion reads the previous one
+		pending := &promotion{readers: 1}
+		cache.promotions[key] = pending
+
+		err = cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img200x200)
+		require.NoError(t, err)
+		require.True(t, pending.stale)
+		require.NotContains(t, cache.promotions, key)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for j := 0; j < 20; j++ {
+					cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
+				}
+			}()
+		}
+		for i := 0; i < 20; i++ {
+			img := img100x100
+			if i%2 == 1 {
+				img = img200x200
+			}
+			require.NoError(t, cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100), img))
+		}
+		wg.Wait()
+
+		cached, err := cache.Get(context.Background(), "www.img.ru/some-img.jpg", fill(100, 100))
+		require.NoError(t, err)
+		require.Equal(t, img200x200.Data, cached.Data)
+		require.Empty(t, cache.promotions)
+	})
+
+	t.Run("too large for memory goes to disk", func(t *testing.T) {
+		cache, disk := newTieredCache(t, int64(len(img100x100.Data)))
+
+		err := cache.Set(context.Background(), "www.img.ru/some-img.jpg", fill(300, 300), img300x300)
+		require.NoError(t, err)
+
+		require.Equal(t, 0, cache.queue.Len())
+
+		_, err = disk.Get(context.Background(), "www.img.ru/some-img.jpg", fill(300, 300))
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,218 @@
+package internalimage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+	"github.com/alexandr-lakeev/otus-final-project/internal/config"
+)
+
+// accessPolicy decides which origins may be requested.
+// A non-empty allow list permits only the matching targets, a deny list blocks the matching ones.
+// The unspecified, loopback and link-local addresses are denied by any active policy.
+// Host names are checked before dialing, resolved addresses are checked right before connecting,
+// so neither redirects nor DNS rebinding can lead to a denied address.
+type accessPolicy struct {
+	allowHosts []string
+	denyHosts  []string
+	allowNets  []*net.IPNet
+	denyNets   []*net.IPNet
+	allowPorts map[int]bool
+	denyPorts  map[int]bool
+}
+
+func newAccessPolicy(cfg config.AccessConf) (*accessPolicy, error) {
+	allowNets, err := parseCIDRs(cfg.AllowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	denyNets, err := parseCIDRs(cfg.DenyCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessPolicy{
+		allowHosts: lowerAll(cfg.AllowHosts),
+		denyHosts:  lowerAll(cfg.DenyHosts),
+		allowNets:  allowNets,
+		denyNets:   denyNets,
+		allowPorts: portSet(cfg.AllowPorts),
+		denyPorts:  portSet(cfg.DenyPorts),
+	}, nil
+}
+
+func (p *accessPolicy) empty() bool {
+	return len(p.allowHosts) == 0 && len(p.denyHosts) == 0 &&
+		len(p.allowNets) == 0 && len(p.denyNets) == 0 &&
+		len(p.allowPorts) == 0 && len(p.denyPorts) == 0
+}
+
+// dialContext checks the requested host name and port before dialing.
+func (p *accessPolicy) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := splitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.checkHost(host, port); err != nil {
+			return nil, err
+		}
+
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// control checks the resolved address right before connecting.
+func (p *accessPolicy) control(network, address string, _ syscall.RawConn) error {
+	host, port, err := splitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: %s is not an ip address", app.ErrForbiddenHost, host)
+	}
+
+	if err := p.checkPort(port); err != nil {
+		return err
+	}
+
+	return p.checkIP(ip)
+}
+
+func (p *accessPolicy) checkHost(host string, port int) error {
+	if err := p.checkPort(port); err != nil {
+		return err
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if len(p.allowHosts) > 0 && !matchHost(p.allowHosts, host) {
+		return fmt.Errorf("%w: %s", app.ErrForbiddenHost, host)
+	}
+
+	if matchHost(p.denyHosts, host) {
+		return fmt.Errorf("%w: %s", app.ErrForbiddenHost, host)
+	}
+
+	// ip literals are checked against the networks as early as possible
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(ip)
+	}
+
+	return nil
+}
+
+func (p *accessPolicy) checkIP(ip net.IP) error {
+	// dialing the unspecified address connects to the local host
+	if ip.IsUnspecified() {
+		return fmt.Errorf("%w: %s", app.ErrForbiddenHost, ip)
+	}
+
+	// the local addresses are denied whatever the deny list is, unless they are allowed explicitly
+	if isLocalIP(ip) && !containsIP(p.allowNets, ip) {
+		return fmt.Errorf("%w: %s", app.ErrForbiddenHost, ip)
+	}
+
+	if len(p.allowNets) > 0 && !containsIP(p.allowNets, ip) {
+		return fmt.Errorf("%w: %s", app.ErrForbiddenHost, ip)
+	}
+
+	if containsIP(p.denyNets, ip) {
+		return fmt.Errorf("%w: %s", app.ErrForbiddenHost, ip)
+	}
+
+	return nil
+}
+
+func (p *accessPolicy) checkPort(port int) error {
+	if len(p.allowPorts) > 0 && !p.allowPorts[port] {
+		return fmt.Errorf("%w: port %d", app.ErrForbiddenHost, port)
+	}
+
+	if p.denyPorts[port] {
+		return fmt.Errorf("%w: port %d", app.ErrForbiddenHost, port)
+	}
+
+	return nil
+}
+
+func splitHostPort(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return host, port, nil
+}
+
+// matchHost supports exact names and glob patterns like *.example.com
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isLocalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+func portSet(ports []int) map[int]bool {
+	set := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		set[port] = true
+	}
+
+	return set
+}
+
+func lowerAll(values []string) []string {
+	lowered := make([]string, 0, len(values))
+	for _, value := range values {
+		lowered = append(lowered, strings.ToLower(value))
+	}
+
+	return lowered
+}
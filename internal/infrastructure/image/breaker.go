@@ -0,0 +1,139 @@
+package internalimage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breakerGrace is how long the failures of a host are kept after the open period, the idle hosts are forgotten
+const breakerGrace = time.Minute
+
+// circuitBreaker stops the requests to the hosts failing in a row.
+// An open host gets a single trial request after the timeout, its result closes or opens the host again.
+type circuitBreaker struct {
+	threshold   int
+	openTimeout time.Duration
+	lock        sync.Mutex
+	hosts       map[string]*hostCircuit
+	sweptAt     time.Time
+}
+
+type hostCircuit struct {
+	state      breakerState
+	failures   int
+	openedAt   time.Time
+	reportedAt time.Time
+	// trial is set while the request of the half-open host is running
+	trial bool
+}
+
+// breakerOutcome is the result of a request as seen by the breaker
+type breakerOutcome int
+
+const (
+	outcomeSuccess breakerOutcome = iota
+	outcomeFailure
+	// outcomeUnknown is the request abandoned by the client, it tells nothing about the host
+	outcomeUnknown
+)
+
+func newCircuitBreaker(threshold int, openTimeout time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold:   threshold,
+		openTimeout: openTimeout,
+		hosts:       make(map[string]*hostCircuit),
+	}
+}
+
+// Allow returns app.ErrOriginUnavailable if the request to the host must not be made,
+// otherwise the result of the request has to be reported
+func (b *circuitBreaker) Allow(host string, now time.Time) error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	circuit, ok := b.hosts[host]
+	if !ok {
+		return nil
+	}
+
+	switch circuit.state {
+	case breakerOpen:
+		if now.Sub(circuit.openedAt) < b.openTimeout {
+			return app.ErrOriginUnavailable
+		}
+		circuit.state = breakerHalfOpen
+		circuit.trial = true
+	case breakerHalfOpen:
+		if circuit.trial {
+			return app.ErrOriginUnavailable
+		}
+		circuit.trial = true
+	case breakerClosed:
+	}
+
+	return nil
+}
+
+func (b *circuitBreaker) Report(host string, outcome breakerOutcome, now time.Time) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	circuit, ok := b.hosts[host]
+
+	switch outcome {
+	case outcomeSuccess:
+		// the healthy hosts are not tracked
+		delete(b.hosts, host)
+	case outcomeFailure:
+		if !ok {
+			circuit = &hostCircuit{}
+			b.hosts[host] = circuit
+		}
+
+		circuit.failures++
+		circuit.trial = false
+		circuit.reportedAt = now
+		if circuit.state == breakerHalfOpen || circuit.failures >= b.threshold {
+			circuit.state = breakerOpen
+			circuit.openedAt = now
+		}
+	case outcomeUnknown:
+		if ok {
+			circuit.trial = false
+		}
+	}
+
+	b.sweep(now)
+}
+
+// sweep forgets the hosts not failed for the open period and the grace, they would be let through anyway
+func (b *circuitBreaker) sweep(now time.Time) {
+	if now.Sub(b.sweptAt) < breakerGrace {
+		return
+	}
+	b.sweptAt = now
+
+	for host, circuit := range b.hosts {
+		if !circuit.trial && now.Sub(circuit.reportedAt) >= b.openTimeout+breakerGrace {
+			delete(b.hosts, host)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package internalimage
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/png"
+	"io"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+	"github.com/alexandr-lakeev/otus-final-project/internal/config"
+	"github.com/alexandr-lakeev/otus-final-project/internal/infrastructure/image/jpeg"
+)
+
+// EncodeFunc writes the image, the quality is 0 for the formats registered without quality
+type EncodeFunc func(w io.Writer, img image.Image, quality int) error
+
+type formatEncoder struct {
+	contentType string
+	lossy       bool
+	encode      EncodeFunc
+}
+
+// ImageEncoder is the registry of the output format encoders
+type ImageEncoder struct {
+	encoders   map[app.ImageFormat]formatEncoder
+	quality    int
+	minQuality int
+	maxQuality int
+}
+
+func NewEncoder(cfg config.EncoderConf) *ImageEncoder {
+	e := &ImageEncoder{
+		encoders:   make(map[app.ImageFormat]formatEncoder),
+		quality:    cfg.Quality,
+		minQuality: cfg.MinQuality,
+		maxQuality: cfg.MaxQuality,
+	}
+
+	e.Register(app.ImageFormatJPEG, "image/jpeg", true, func(w io.Writer, img image.Image, quality int) error {
+		return jpeg.Encode(w, img, &jpeg.Options{
+			Quality:     quality,
+			Progressive: cfg.JPEGProgressive,
+		})
+	})
+	e.Register(app.ImageFormatPNG, "image/png", false, func(w io.Writer, img image.Image, quality int) error {
+		return png.Encode(w, img)
+	})
+	e.Register(app.ImageFormatGIF, "image/gif", false, func(w io.Writer, img image.Image, quality int) error {
+		return gif.Encode(w, img, nil)
+	})
+
+	return e
+}
+
+// Register adds or replaces the encoder of the format, e.g. a WebP or an AVIF encoder.
+// A lossy encoder gets the quality of the request.
+func (e *ImageEncoder) Register(format app.ImageFormat, contentType string, lossy bool, encode EncodeFunc) {
+	e.encoders[format] = formatEncoder{
+		contentType: contentType,
+		lossy:       lossy,
+		encode:      encode,
+	}
+}
+
+func (e *ImageEncoder) ContentTypes() map[app.ImageFormat]string {
+	contentTypes := make(map[app.ImageFormat]string, len(e.encoders))
+	for format, encoder := range e.encoders {
+		contentTypes[format] = encoder.contentType
+	}
+
+	return contentTypes
+}
+
+// Quality returns the default quality for zero and clamps the requested one to the configured bounds
+func (e *ImageEncoder) Quality(format app.ImageFormat, requested int) int {
+	if !e.encoders[format].lossy {
+		return 0
+	}
+
+	quality := requested
+	if quality == 0 {
+		quality = e.quality
+	}
+
+	if quality < e.minQuality {
+		quality = e.minQuality
+	}
+	if quality > e.maxQuality {
+		quality = e.maxQuality
+	}
+
+	return quality
+}
+
+func (e *ImageEncoder) Encode(img image.Image, format app.ImageFormat, quality int) (*app.EncodedImage, error) {
+	encoder, ok := e.encoders[format]
+	if !ok {
+		return nil, app.ErrUnsupportedFormat
+	}
+
+	var buf bytes.Buffer
+
+	if err := encoder.encode(&buf, img, quality); err != nil {
+		return nil, err
+	}
+
+	return &app.EncodedImage{
+		Data:        buf.Bytes(),
+		ContentType: encoder.contentType,
+	}, nil
+}
@@ -0,0 +1,138 @@
+package internalimage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+	"github.com/alexandr-lakeev/otus-final-project/internal/config"
+)
+
+// FileLoader loads the images of the local directory, the host and the path of file:// urls
+// are resolved under the root and may not leave it, neither by dot segments nor by symlinks
+type FileLoader struct {
+	root            string
+	maxBodyBytes    int64
+	maxSourcePixels int64
+	defaultTTL      time.Duration
+	maxTTL          time.Duration
+}
+
+func NewFileLoader(cfg config.LoaderConf) (*FileLoader, error) {
+	root, err := filepath.Abs(cfg.File.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	// the resolved files are compared with the real root
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileLoader{
+		root:            root,
+		maxBodyBytes:    cfg.MaxBodyBytes,
+		maxSourcePixels: cfg.MaxSourcePixels,
+		defaultTTL:      cfg.DefaultTTL,
+		maxTTL:          cfg.MaxTTL,
+	}, nil
+}
+
+func (l *FileLoader) Load(ctx context.Context, request *app.LoadRequest) (*app.LoadedImage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	parsedUrl, err := url.Parse(request.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsedUrl.Scheme != "file" {
+		return nil, app.ErrUnsupportedScheme
+	}
+
+	name, err := l.resolve(parsedUrl.Host + "/" + parsedUrl.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, l.wrapError(err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, l.wrapError(err)
+	}
+
+	if info.IsDir() {
+		return nil, app.ErrImageNotFound
+	}
+
+	origin := app.Origin{
+		ETag:         fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()),
+		LastModified: info.ModTime().UTC().Format(http.TimeFormat),
+		Expires:      time.Now().Add(limitTTL(l.defaultTTL, l.maxTTL)),
+	}
+
+	if previous := request.Previous; previous != nil && previous.ETag == origin.ETag {
+		return &app.LoadedImage{Origin: origin, NotModified: true}, nil
+	}
+
+	if l.maxBodyBytes > 0 && info.Size() > l.maxBodyBytes {
+		return nil, app.ErrImageTooLarge
+	}
+
+	body, err := readLimited(file, l.maxBodyBytes)
+	if err != nil {
+		return nil, l.wrapError(err)
+	}
+
+	img, err := decodeImage(body, l.maxSourcePixels)
+	if err != nil {
+		return nil, err
+	}
+
+	return &app.LoadedImage{Image: img, Origin: origin}, nil
+}
+
+// resolve returns the real name of the file, the files outside the root are reported as missing
+func (l *FileLoader) resolve(name string) (string, error) {
+	// cleaning the rooted path drops the dot segments leading above the root
+	name = filepath.Join(l.root, filepath.FromSlash(path.Clean("/"+name)))
+
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return "", l.wrapError(err)
+	}
+
+	if resolved != l.root && !strings.HasPrefix(resolved, l.root+string(filepath.Separator)) {
+		return "", app.ErrImageNotFound
+	}
+
+	return resolved, nil
+}
+
+func (l *FileLoader) wrapError(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", app.ErrImageNotFound, err)
+	}
+
+	if errors.Is(err, app.ErrImageTooLarge) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %s", app.ErrInternal, err)
+}
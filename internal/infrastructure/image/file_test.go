@@ -0,0 +1,97 @@
+package internalimage
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+	"github.com/alexandr-lakeev/otus-final-project/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func writePNG(t *testing.T, name string) {
+	t.Helper()
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(name), 0o755))
+
+	file, err := os.Create(name)
+	require.NoError(t, err)
+	defer file.Close()
+
+	require.NoError(t, png.Encode(file, image.NewNRGBA(image.Rect(0, 0, 10, 10))))
+}
+
+func TestFileLoader(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+
+	writePNG(t, filepath.Join(root, "catalog", "img.png"))
+	writePNG(t, filepath.Join(dir, "secret.png"))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "text.txt"), []byte("not an image"), 0o600))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "secret.png"), filepath.Join(root, "escape.png")))
+	require.NoError(t, os.Symlink(filepath.Join(root, "catalog"), filepath.Join(root, "linked")))
+
+	loader, err := NewFileLoader(config.LoaderConf{File: config.FileConf{Root: root}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		url  string
+		err  error
+	}{
+		{name: "absolute path", url: "file:///catalog/img.png"},
+		{name: "host is the first segment", url: "file://catalog/img.png"},
+		{name: "symlink inside the root", url: "file:///linked/img.png"},
+		{name: "dot segments stay under the root", url: "file:///../../catalog/img.png"},
+		{name: "escaped dot segments", url: "file:///%2e%2e/secret.png", err: app.ErrImageNotFound},
+		{name: "traversal", url: "file:///catalog/../../secret.png", err: app.ErrImageNotFound},
+		{name: "symlink outside the root", url: "file:///escape.png", err: app.ErrImageNotFound},
+		{name: "missing", url: "file:///catalog/missing.png", err: app.ErrImageNotFound},
+		{name: "directory", url: "file:///catalog", err: app.ErrImageNotFound},
+		{name: "not an image", url: "file:///text.txt", err: app.ErrContentNotImage},
+		{name: "other scheme", url: "http://catalog/img.png", err: app.ErrUnsupportedScheme},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loaded, err := loader.Load(context.Background(), &app.LoadRequest{Url: tt.url})
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, 10, loaded.Image.Bounds().Dx())
+		})
+	}
+
+	t.Run("revalidation", func(t *testing.T) {
+		loaded, err := loader.Load(context.Background(), &app.LoadRequest{Url: "file:///catalog/img.png"})
+		require.NoError(t, err)
+		require.NotEmpty(t, loaded.Origin.ETag)
+		require.NotEmpty(t, loaded.Origin.LastModified)
+
+		previous := loaded.Origin
+		loaded, err = loader.Load(context.Background(), &app.LoadRequest{Url: "file:///catalog/img.png", Previous: &previous})
+		require.NoError(t, err)
+		require.True(t, loaded.NotModified)
+
+		previous.ETag = `"changed"`
+		loaded, err = loader.Load(context.Background(), &app.LoadRequest{Url: "file:///catalog/img.png", Previous: &previous})
+		require.NoError(t, err)
+		require.False(t, loaded.NotModified)
+		require.NotNil(t, loaded.Image)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		loader, err := NewFileLoader(config.LoaderConf{File: config.FileConf{Root: root}, MaxBodyBytes: 10})
+		require.NoError(t, err)
+
+		_, err = loader.Load(context.Background(), &app.LoadRequest{Url: "file:///catalog/img.png"})
+		require.ErrorIs(t, err, app.ErrImageTooLarge)
+	})
+}
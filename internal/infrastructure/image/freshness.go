@@ -0,0 +1,111 @@
+package internalimage
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// freshness returns how long the response stays fresh according to its headers,
+// ok is false when the origin has not told it
+func freshness(header http.Header, now time.Time) (ttl time.Duration, ok bool) {
+	directives := parseCacheControl(header.Values("Cache-Control"))
+
+	for _, name := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[name]; ok {
+			return 0, true
+		}
+	}
+
+	// the previewer is a shared cache, so s-maxage takes precedence
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[name]; ok {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds < 0 {
+				return 0, true
+			}
+
+			return nonNegative(time.Duration(seconds)*time.Second - age(header)), true
+		}
+	}
+
+	expires := header.Get("Expires")
+	if expires == "" {
+		return 0, false
+	}
+
+	// an invalid date means the response has already expired
+	expiresAt, err := http.ParseTime(expires)
+	if err != nil {
+		return 0, true
+	}
+
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = now
+	}
+
+	return nonNegative(expiresAt.Sub(date) - age(header)), true
+}
+
+// noStore reports whether the response must not be kept by a shared cache
+func noStore(header http.Header) bool {
+	directives := parseCacheControl(header.Values("Cache-Control"))
+
+	_, store := directives["no-store"]
+	_, private := directives["private"]
+
+	return store || private
+}
+
+// mustRevalidate reports whether the response must not be used after it has expired
+func mustRevalidate(header http.Header) bool {
+	directives := parseCacheControl(header.Values("Cache-Control"))
+
+	for _, name := range []string{"must-revalidate", "proxy-revalidate", "no-cache"} {
+		if _, ok := directives[name]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseCacheControl(values []string) map[string]string {
+	directives := make(map[string]string)
+
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			name, arg := part, ""
+			if i := strings.Index(part, "="); i >= 0 {
+				name, arg = part[:i], strings.Trim(strings.TrimSpace(part[i+1:]), `"`)
+			}
+
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "" {
+				directives[name] = arg
+			}
+		}
+	}
+
+	return directives
+}
+
+// age is the time the response has already spent in the caches on the way
+func age(header http.Header) time.Duration {
+	seconds, err := strconv.ParseInt(strings.TrimSpace(header.Get("Age")), 10, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+func nonNegative(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+
+	return d
+}
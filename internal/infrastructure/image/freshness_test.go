@@ -0,0 +1,98 @@
+package internalimage
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreshness(t *testing.T) {
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		ttl     time.Duration
+		ok      bool
+	}{
+		{name: "no headers"},
+		{name: "max-age", headers: map[string]string{"Cache-Control": "public, max-age=600"}, ttl: 10 * time.Minute, ok: true},
+		{name: "s-maxage", headers: map[string]string{"Cache-Control": "max-age=600, s-maxage=60"}, ttl: time.Minute, ok: true},
+		{name: "quoted", headers: map[string]string{"Cache-Control": `max-age="60"`}, ttl: time.Minute, ok: true},
+		{name: "age", headers: map[string]string{"Cache-Control": "max-age=600", "Age": "60"}, ttl: 9 * time.Minute, ok: true},
+		{name: "older than max-age", headers: map[string]string{"Cache-Control": "max-age=60", "Age": "600"}, ok: true},
+		{name: "invalid max-age", headers: map[string]string{"Cache-Control": "max-age=soon"}, ok: true},
+		{name: "no-cache", headers: map[string]string{"Cache-Control": "No-Cache, max-age=600"}, ok: true},
+		{name: "no-store", headers: map[string]string{"Cache-Control": "no-store"}, ok: true},
+		{name: "private", headers: map[string]string{"Cache-Control": "private, max-age=600"}, ok: true},
+		{name: "other directives", headers: map[string]string{"Cache-Control": "public"}},
+		{
+			name: "expires",
+			headers: map[string]string{
+				"Expires": now.Add(time.Hour).Format(http.TimeFormat),
+			},
+			ttl: time.Hour,
+			ok:  true,
+		},
+		{
+			name: "expires relative to date",
+			headers: map[string]string{
+				"Expires": now.Add(time.Hour).Format(http.TimeFormat),
+				"Date":    now.Add(-time.Hour).Format(http.TimeFormat),
+			},
+			ttl: 2 * time.Hour,
+			ok:  true,
+		},
+		{
+			name: "max-age takes precedence",
+			headers: map[string]string{
+				"Cache-Control": "max-age=60",
+				"Expires":       now.Add(time.Hour).Format(http.TimeFormat),
+			},
+			ttl: time.Minute,
+			ok:  true,
+		},
+		{name: "expired", headers: map[string]string{"Expires": now.Add(-time.Hour).Format(http.TimeFormat)}, ok: true},
+		{name: "invalid expires", headers: map[string]string{"Expires": "0"}, ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(http.Header)
+			for name, value := range tt.headers {
+				header.Set(name, value)
+			}
+
+			ttl, ok := freshness(header, now)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.ttl, ttl)
+		})
+	}
+}
+
+func TestMustRevalidate(t *testing.T) {
+	for value, expected := range map[string]bool{
+		"":                             false,
+		"public, max-age=600":          false,
+		"max-age=600, must-revalidate": true,
+		"Proxy-Revalidate":             true,
+		"no-cache":                     true,
+	} {
+		require.Equal(t, expected, mustRevalidate(http.Header{"Cache-Control": {value}}), value)
+	}
+}
+
+func TestNoStore(t *testing.T) {
+	for value, expected := range map[string]bool{
+		"":                     false,
+		"public, max-age=600":  false,
+		"no-cache":             false,
+		"No-Store":             true,
+		"private, max-age=600": true,
+		`private="Set-Cookie"`: true,
+	} {
+		require.Equal(t, expected, noStore(http.Header{"Cache-Control": {value}}), value)
+	}
+}
@@ -0,0 +1,130 @@
+package internalimage
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/config"
+)
+
+// hopByHopHeaders belong to the client connection (RFC 7230), the headers listed in Connection are dropped too
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// transportHeaders are set by the http client itself, the client compresses the responses
+// only when Accept-Encoding is not given
+var transportHeaders = []string{
+	"Accept-Encoding",
+	"Content-Length",
+	"Host",
+}
+
+// conditionalHeaders of the client refer to the previews, the loader sets its own ones
+var conditionalHeaders = []string{
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+	"If-Range",
+	"Range",
+}
+
+// headerPolicy makes the headers of the origin request out of the client ones
+type headerPolicy struct {
+	dropped      map[string]bool
+	allow        map[string]bool
+	deny         map[string]bool
+	rename       map[string]string
+	inject       http.Header
+	forwardedFor bool
+	via          string
+}
+
+func newHeaderPolicy(cfg config.HeadersConf) *headerPolicy {
+	policy := &headerPolicy{
+		dropped:      canonicalSet(append(append(hopByHopHeaders, transportHeaders...), conditionalHeaders...)),
+		allow:        canonicalSet(cfg.Allow),
+		deny:         canonicalSet(cfg.Deny),
+		rename:       make(map[string]string, len(cfg.Rename)),
+		inject:       make(http.Header, len(cfg.Inject)),
+		forwardedFor: cfg.ForwardedFor,
+		via:          cfg.Via,
+	}
+
+	for from, to := range cfg.Rename {
+		policy.rename[textproto.CanonicalMIMEHeaderKey(from)] = textproto.CanonicalMIMEHeaderKey(to)
+	}
+
+	for name, value := range cfg.Inject {
+		policy.inject.Set(name, value)
+	}
+
+	return policy
+}
+
+// apply filters and renames the client headers, then adds the proxy ones and the injected ones
+func (p *headerPolicy) apply(headers http.Header, clientIP string) http.Header {
+	listed := make(map[string]bool)
+	for _, value := range headers.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			listed[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	result := make(http.Header)
+
+	for name, values := range headers {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if p.dropped[name] || listed[name] || p.deny[name] || (len(p.allow) > 0 && !p.allow[name]) {
+			continue
+		}
+
+		if renamed, ok := p.rename[name]; ok {
+			name = renamed
+		}
+
+		result[name] = append(result[name], values...)
+	}
+
+	if p.forwardedFor && clientIP != "" {
+		appendHeader(result, "X-Forwarded-For", clientIP)
+	}
+
+	if p.via != "" {
+		appendHeader(result, "Via", "1.1 "+p.via)
+	}
+
+	for name, values := range p.inject {
+		result[name] = append([]string(nil), values...)
+	}
+
+	return result
+}
+
+// appendHeader adds the value to the comma separated list kept in a single header
+func appendHeader(headers http.Header, name, value string) {
+	if prior := headers.Values(name); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+
+	headers.Set(name, value)
+}
+
+func canonicalSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+
+	return set
+}
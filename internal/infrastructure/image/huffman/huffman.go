@@ -0,0 +1,111 @@
+// Package huffman calculates the length limited Huffman codes of the jpeg encoder.
+package huffman
+
+import "container/heap"
+
+// Lengths calculates the Huffman code lengths limited by maxLength.
+// If the tree is too deep, the counts are flattened until it fits.
+func Lengths(histogram []uint32, maxLength int) []uint8 {
+	counts := make([]uint32, len(histogram))
+	copy(counts, histogram)
+
+	for {
+		lengths, depth := huffmanLengths(counts)
+		if depth <= maxLength {
+			return lengths
+		}
+
+		for i, count := range counts {
+			if count > 0 {
+				counts[i] = (count + 1) / 2
+			}
+		}
+	}
+}
+
+func huffmanLengths(counts []uint32) ([]uint8, int) {
+	lengths := make([]uint8, len(counts))
+
+	nodes := make([]huffmanNode, 0, 2*len(counts))
+	queue := &nodeQueue{nodes: &nodes}
+
+	for symbol, count := range counts {
+		if count > 0 {
+			nodes = append(nodes, huffmanNode{count: count, symbol: symbol, left: -1, right: -1})
+			queue.items = append(queue.items, len(nodes)-1)
+		}
+	}
+
+	if len(queue.items) < 2 {
+		return lengths, 0
+	}
+
+	heap.Init(queue)
+	for queue.Len() > 1 {
+		left := heap.Pop(queue).(int)
+		right := heap.Pop(queue).(int)
+
+		nodes = append(nodes, huffmanNode{
+			count:  nodes[left].count + nodes[right].count,
+			symbol: -1,
+			left:   left,
+			right:  right,
+		})
+		heap.Push(queue, len(nodes)-1)
+	}
+
+	depth := 0
+
+	var walk func(node, level int)
+	walk = func(node, level int) {
+		if nodes[node].symbol >= 0 {
+			lengths[nodes[node].symbol] = uint8(level)
+			if level > depth {
+				depth = level
+			}
+			return
+		}
+
+		walk(nodes[node].left, level+1)
+		walk(nodes[node].right, level+1)
+	}
+	walk(queue.items[0], 0)
+
+	return lengths, depth
+}
+
+type huffmanNode struct {
+	count  uint32
+	symbol int
+	left   int
+	right  int
+}
+
+// nodeQueue is a min heap of the node indexes ordered by the count
+type nodeQueue struct {
+	nodes *[]huffmanNode
+	items []int
+}
+
+func (q *nodeQueue) Len() int {
+	return len(q.items)
+}
+
+func (q *nodeQueue) Less(i, j int) bool {
+	return (*q.nodes)[q.items[i]].count < (*q.nodes)[q.items[j]].count
+}
+
+func (q *nodeQueue) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+}
+
+func (q *nodeQueue) Push(x interface{}) {
+	q.items = append(q.items, x.(int))
+}
+
+func (q *nodeQueue) Pop() interface{} {
+	last := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+
+	return last
+}
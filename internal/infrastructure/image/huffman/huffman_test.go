@@ -0,0 +1,41 @@
+package huffman
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLengths(t *testing.T) {
+	tests := []struct {
+		name      string
+		histogram []uint32
+		maxLength int
+	}{
+		{name: "frequent symbols are shorter", histogram: []uint32{50, 20, 20, 5, 5}, maxLength: 15},
+		{name: "unused symbols", histogram: []uint32{0, 7, 0, 3, 1, 0}, maxLength: 15},
+		{name: "limited depth", histogram: []uint32{1, 1, 2, 3, 5, 8, 13, 21, 34, 55, 89, 144, 233, 377, 610, 987, 1597, 2584}, maxLength: 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lengths := Lengths(tt.histogram, tt.maxLength)
+			require.Len(t, lengths, len(tt.histogram))
+
+			// the code is complete: the Kraft sum of the used symbols is exactly one
+			kraft := 0
+			for symbol, length := range lengths {
+				require.Equal(t, tt.histogram[symbol] == 0, length == 0)
+				require.LessOrEqual(t, int(length), tt.maxLength)
+
+				if length > 0 {
+					kraft += 1 << (tt.maxLength - int(length))
+				}
+			}
+			require.Equal(t, 1<<tt.maxLength, kraft)
+		})
+	}
+
+	// a single symbol takes no bits
+	require.Equal(t, []uint8{0, 0, 0}, Lengths([]uint32{0, 5, 0}, 15))
+}
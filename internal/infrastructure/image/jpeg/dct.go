@@ -0,0 +1,110 @@
+package jpeg
+
+import "math"
+
+const blockSize = 64
+
+// zigzag maps the zigzag order to the natural order of the block
+var zigzag = [blockSize]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// luminanceQuant and chrominanceQuant are the tables from the JPEG specification in the natural order
+var luminanceQuant = [blockSize]int32{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}
+
+var chrominanceQuant = [blockSize]int32{
+	17, 18, 24, 47, 99, 99, 99, 99,
+	18, 21, 26, 66, 99, 99, 99, 99,
+	24, 26, 56, 99, 99, 99, 99, 99,
+	47, 66, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+}
+
+// cosines[u][x] holds C(u)/2 * cos((2x+1)uπ/16)
+var cosines = func() (table [8][8]float32) {
+	for u := 0; u < 8; u++ {
+		scale := 0.5
+		if u == 0 {
+			scale = 0.5 / math.Sqrt2
+		}
+
+		for x := 0; x < 8; x++ {
+			table[u][x] = float32(scale * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16))
+		}
+	}
+
+	return table
+}()
+
+// scaleQuant scales the table by the quality the way libjpeg does and returns it in the zigzag order
+func scaleQuant(base *[blockSize]int32, quality int) [blockSize]int32 {
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+
+	scale := int32(200 - 2*quality)
+	if quality < 50 {
+		scale = int32(5000 / quality)
+	}
+
+	var quant [blockSize]int32
+	for k, natural := range zigzag {
+		q := (base[natural]*scale + 50) / 100
+		if q < 1 {
+			q = 1
+		} else if q > 255 {
+			q = 255
+		}
+		quant[k] = q
+	}
+
+	return quant
+}
+
+// fdct is the separable forward DCT of the level shifted samples, the result is in the natural order
+func fdct(samples *[blockSize]float32) [blockSize]float32 {
+	var rows, coefs [blockSize]float32
+
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			sum := float32(0)
+			for x := 0; x < 8; x++ {
+				sum += (samples[y*8+x] - 128) * cosines[u][x]
+			}
+			rows[y*8+u] = sum
+		}
+	}
+
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			sum := float32(0)
+			for y := 0; y < 8; y++ {
+				sum += rows[y*8+u] * cosines[v][y]
+			}
+			coefs[v*8+u] = sum
+		}
+	}
+
+	return coefs
+}
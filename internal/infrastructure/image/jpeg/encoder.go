@@ -0,0 +1,402 @@
+// Package jpeg implements a JPEG encoder with optimized Huffman tables and progressive output.
+//
+// The encoder of the standard library writes baseline images with the fixed example Huffman tables only.
+// The optimized tables make the previews smaller at the same quality, and the progressive ones are shown
+// before they are loaded completely; neither can be added to image/jpeg from outside.
+//
+// The image is always encoded as YCbCr with 4:2:0 chroma subsampling.
+// Progressive images use spectral selection only, without successive approximation.
+package jpeg
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"io"
+	"math"
+)
+
+const (
+	maxDimension = 1<<16 - 1
+
+	DefaultQuality = 75
+)
+
+var ErrTooLarge = errors.New("jpeg: image is too large")
+
+type Options struct {
+	Quality     int
+	Progressive bool
+}
+
+// scan is a part of the entropy coded data: a band of the coefficients of the components
+type scan struct {
+	components []int
+	ss, se     int
+}
+
+var baselineScans = []scan{
+	{components: []int{0, 1, 2}, ss: 0, se: 63},
+}
+
+// progressiveScans send the DC of all the components first, then the low and the high luma frequencies
+// around the chroma, so the rough image is shown early
+var progressiveScans = []scan{
+	{components: []int{0, 1, 2}, ss: 0, se: 0},
+	{components: []int{0}, ss: 1, se: 5},
+	{components: []int{1}, ss: 1, se: 63},
+	{components: []int{2}, ss: 1, se: 63},
+	{components: []int{0}, ss: 6, se: 63},
+}
+
+func Encode(w io.Writer, img image.Image, o *Options) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if width < 1 || height < 1 || width > maxDimension || height > maxDimension {
+		return ErrTooLarge
+	}
+
+	quality, progressive := DefaultQuality, false
+	if o != nil {
+		quality, progressive = o.Quality, o.Progressive
+	}
+
+	e := &encoder{
+		w:      bufio.NewWriter(w),
+		width:  width,
+		height: height,
+	}
+	e.bits.w = e
+
+	e.quant[0] = scaleQuant(&luminanceQuant, quality)
+	e.quant[1] = scaleQuant(&chrominanceQuant, quality)
+	e.transform(img)
+
+	e.writeMarker(markerSOI, nil)
+	e.writeDQT()
+
+	scans := baselineScans
+	if progressive {
+		scans = progressiveScans
+		e.writeSOF(markerSOF2)
+	} else {
+		e.writeSOF(markerSOF0)
+	}
+
+	for _, s := range scans {
+		e.writeScan(s)
+	}
+
+	e.writeMarker(markerEOI, nil)
+
+	if e.err != nil {
+		return e.err
+	}
+
+	return e.w.Flush()
+}
+
+// component is a color plane split into the 8x8 blocks of the quantized coefficients in the zigzag order
+type component struct {
+	// the blocks per row including the MCU padding
+	stride int
+	// the blocks covering the component without the MCU padding, they are coded by the non-interleaved scans
+	blocksX, blocksY int
+	blocks           [][blockSize]int32
+	quant            int
+}
+
+type encoder struct {
+	w   *bufio.Writer
+	err error
+
+	width, height int
+	mcusX, mcusY  int
+
+	quant      [2][blockSize]int32
+	components [3]component
+
+	bits bitWriter
+
+	// counting collects the symbol frequencies instead of writing the symbols
+	counting bool
+	dc, ac   [2]*huffmanTable
+	eobRun   int
+}
+
+// transform converts the image to YCbCr, subsamples the chroma and quantizes the DCT coefficients
+func (e *encoder) transform(img image.Image) {
+	e.mcusX, e.mcusY = (e.width+15)/16, (e.height+15)/16
+
+	planeWidth, planeHeight := e.mcusX*16, e.mcusY*16
+	planes := [3][]float32{
+		make([]float32, planeWidth*planeHeight),
+		make([]float32, planeWidth*planeHeight),
+		make([]float32, planeWidth*planeHeight),
+	}
+
+	bounds := img.Bounds()
+	for y := 0; y < planeHeight; y++ {
+		// the padding repeats the edge pixels
+		sy := bounds.Min.Y + minInt(y, e.height-1)
+		for x := 0; x < planeWidth; x++ {
+			sx := bounds.Min.X + minInt(x, e.width-1)
+			r, g, b, _ := img.At(sx, sy).RGBA()
+			cy, cb, cr := rgbToYCbCr(float32(r>>8), float32(g>>8), float32(b>>8))
+
+			i := y*planeWidth + x
+			planes[0][i], planes[1][i], planes[2][i] = cy, cb, cr
+		}
+	}
+
+	chromaWidth, chromaHeight := planeWidth/2, planeHeight/2
+	for c := 1; c < 3; c++ {
+		plane := planes[c]
+		subsampled := make([]float32, chromaWidth*chromaHeight)
+		for y := 0; y < chromaHeight; y++ {
+			for x := 0; x < chromaWidth; x++ {
+				i := 2*y*planeWidth + 2*x
+				subsampled[y*chromaWidth+x] = (plane[i] + plane[i+1] + plane[i+planeWidth] + plane[i+planeWidth+1]) / 4
+			}
+		}
+		planes[c] = subsampled
+	}
+
+	e.components[0] = e.newComponent(planes[0], planeWidth, planeHeight, e.width, e.height, 0)
+	for c := 1; c < 3; c++ {
+		e.components[c] = e.newComponent(planes[c], chromaWidth, chromaHeight, (e.width+1)/2, (e.height+1)/2, 1)
+	}
+}
+
+func (e *encoder) newComponent(plane []float32, planeWidth, planeHeight, width, height, quant int) component {
+	c := component{
+		stride:  planeWidth / 8,
+		blocksX: (width + 7) / 8,
+		blocksY: (height + 7) / 8,
+		blocks:  make([][blockSize]int32, planeWidth/8*planeHeight/8),
+		quant:   quant,
+	}
+
+	var samples [blockSize]float32
+	for by := 0; by < planeHeight/8; by++ {
+		for bx := 0; bx < c.stride; bx++ {
+			for y := 0; y < 8; y++ {
+				copy(samples[y*8:y*8+8], plane[(by*8+y)*planeWidth+bx*8:])
+			}
+
+			coefs := fdct(&samples)
+			block := &c.blocks[by*c.stride+bx]
+			for k, natural := range zigzag {
+				block[k] = int32(math.Round(float64(coefs[natural] / float32(e.quant[quant][k]))))
+			}
+		}
+	}
+
+	return c
+}
+
+// writeScan writes the scan twice: the first pass collects the statistics for the optimal Huffman tables.
+func (e *encoder) writeScan(s scan) {
+	for i := range e.dc {
+		e.dc[i], e.ac[i] = &huffmanTable{}, &huffmanTable{}
+	}
+
+	e.counting = true
+	e.encodeScan(s)
+
+	e.counting = false
+	e.writeDHT(s)
+	e.writeSOS(s)
+	e.encodeScan(s)
+	e.bits.flush()
+}
+
+func (e *encoder) encodeScan(s scan) {
+	var pred [3]int32
+	e.eobRun = 0
+
+	if len(s.components) > 1 {
+		for my := 0; my < e.mcusY; my++ {
+			for mx := 0; mx < e.mcusX; mx++ {
+				for _, c := range s.components {
+					// the luma has 2x2 blocks in the MCU, the subsampled chroma has a single one
+					size := 1
+					if c == 0 {
+						size = 2
+					}
+
+					comp := &e.components[c]
+					for y := 0; y < size; y++ {
+						for x := 0; x < size; x++ {
+							block := &comp.blocks[(my*size+y)*comp.stride+mx*size+x]
+							e.encodeBlock(s, c, block, &pred[c])
+						}
+					}
+				}
+			}
+		}
+	} else {
+		c := s.components[0]
+		comp := &e.components[c]
+		for by := 0; by < comp.blocksY; by++ {
+			for bx := 0; bx < comp.blocksX; bx++ {
+				e.encodeBlock(s, c, &comp.blocks[by*comp.stride+bx], &pred[c])
+			}
+		}
+	}
+
+	e.flushEOBRun(e.ac[e.acTable(s, s.components[0])])
+}
+
+func (e *encoder) encodeBlock(s scan, c int, block *[blockSize]int32, pred *int32) {
+	if s.ss == 0 {
+		e.emitValue(e.dc[e.dcTable(c)], 0, block[0]-*pred)
+		*pred = block[0]
+	}
+
+	if s.se == 0 {
+		return
+	}
+
+	ac := e.ac[e.acTable(s, c)]
+	progressive := s.ss > 0
+
+	run := 0
+	for k := maxInt(s.ss, 1); k <= s.se; k++ {
+		if block[k] == 0 {
+			run++
+			continue
+		}
+
+		if progressive {
+			e.flushEOBRun(ac)
+		}
+
+		for ; run > 15; run -= 16 {
+			e.emitSymbol(ac, 0xf0)
+		}
+
+		e.emitValue(ac, run, block[k])
+		run = 0
+	}
+
+	if run == 0 {
+		return
+	}
+
+	// the rest of the band is zero
+	if !progressive {
+		e.emitSymbol(ac, 0x00)
+		return
+	}
+
+	e.eobRun++
+	if e.eobRun == 0x7fff {
+		e.flushEOBRun(ac)
+	}
+}
+
+func (e *encoder) flushEOBRun(ac *huffmanTable) {
+	if e.eobRun == 0 {
+		return
+	}
+
+	n := bitLength(uint32(e.eobRun)) - 1
+	e.emitSymbol(ac, byte(n<<4))
+	e.emitBits(uint32(e.eobRun), n)
+	e.eobRun = 0
+}
+
+// emitValue writes the run of zeros and the size of the value as a symbol followed by the value bits
+func (e *encoder) emitValue(t *huffmanTable, run int, value int32) {
+	magnitude := value
+	if value < 0 {
+		magnitude = -value
+		value--
+	}
+
+	size := bitLength(uint32(magnitude))
+	e.emitSymbol(t, byte(run<<4|size))
+	e.emitBits(uint32(value), size)
+}
+
+func (e *encoder) emitSymbol(t *huffmanTable, symbol byte) {
+	if e.counting {
+		t.counts[symbol]++
+		return
+	}
+
+	e.bits.writeBits(uint32(t.codes[symbol]), int(t.lengths[symbol]))
+}
+
+func (e *encoder) emitBits(bits uint32, n int) {
+	if e.counting || n == 0 {
+		return
+	}
+
+	e.bits.writeBits(bits&(1<<n-1), n)
+}
+
+// dcTable returns the table of the component, the chroma components share one
+func (e *encoder) dcTable(c int) int {
+	return minInt(c, 1)
+}
+
+func (e *encoder) acTable(s scan, c int) int {
+	// a progressive scan has a single component, so it takes the first table
+	if len(s.components) == 1 {
+		return 0
+	}
+
+	return minInt(c, 1)
+}
+
+func (e *encoder) write(p []byte) {
+	if e.err != nil {
+		return
+	}
+
+	_, e.err = e.w.Write(p)
+}
+
+func (e *encoder) writeByte(b byte) {
+	if e.err != nil {
+		return
+	}
+
+	e.err = e.w.WriteByte(b)
+}
+
+func rgbToYCbCr(r, g, b float32) (float32, float32, float32) {
+	y := 0.299*r + 0.587*g + 0.114*b
+	cb := -0.168736*r - 0.331264*g + 0.5*b + 128
+	cr := 0.5*r - 0.418688*g - 0.081312*b + 128
+
+	return y, cb, cr
+}
+
+func bitLength(v uint32) int {
+	n := 0
+	for ; v > 0; v >>= 1 {
+		n++
+	}
+
+	return n
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,173 @@
+package jpeg
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	stdjpeg "image/jpeg"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncode(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	images := []struct {
+		name string
+		img  image.Image
+		// the mean absolute error of a channel at the quality 90
+		maxError float64
+	}{
+		{name: "single pixel", img: solidImage(1, 1, color.NRGBA{R: 10, G: 200, B: 30, A: 255}), maxError: 3},
+		{name: "solid", img: solidImage(64, 48, color.NRGBA{R: 255, G: 255, B: 255, A: 255}), maxError: 1},
+		{name: "gradient", img: gradientImage(256, 100), maxError: 3},
+		{name: "odd size", img: gradientImage(37, 23), maxError: 3},
+		{name: "offset bounds", img: gradientImage(300, 90).(*image.NRGBA).SubImage(image.Rect(17, 5, 290, 71)), maxError: 3},
+		{name: "noise", img: randomImage(random, 41, 29), maxError: 50},
+	}
+
+	for _, progressive := range []bool{false, true} {
+		for _, tc := range images {
+			tc, progressive := tc, progressive
+			name := tc.name
+			if progressive {
+				name += " progressive"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				var buf bytes.Buffer
+				require.NoError(t, Encode(&buf, tc.img, &Options{Quality: 90, Progressive: progressive}))
+
+				sof := []byte{0xff, markerSOF0}
+				if progressive {
+					sof = []byte{0xff, markerSOF2}
+				}
+				require.True(t, bytes.Contains(buf.Bytes(), sof))
+
+				decoded, err := stdjpeg.Decode(&buf)
+				require.NoError(t, err)
+				require.Equal(t, tc.img.Bounds().Size(), decoded.Bounds().Size())
+				require.Less(t, meanError(tc.img, decoded), tc.maxError)
+			})
+		}
+	}
+
+	t.Run("quality", func(t *testing.T) {
+		img := gradientImage(128, 128)
+
+		var low, high bytes.Buffer
+		require.NoError(t, Encode(&low, img, &Options{Quality: 20}))
+		require.NoError(t, Encode(&high, img, &Options{Quality: 95}))
+
+		require.Less(t, low.Len(), high.Len())
+	})
+
+	t.Run("optimized tables", func(t *testing.T) {
+		img := gradientImage(256, 256)
+
+		var standard, optimized bytes.Buffer
+		require.NoError(t, stdjpeg.Encode(&standard, img, &stdjpeg.Options{Quality: 90}))
+		require.NoError(t, Encode(&optimized, img, &Options{Quality: 90}))
+
+		require.Less(t, optimized.Len(), standard.Len())
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		require.ErrorIs(t, Encode(&bytes.Buffer{}, image.NewNRGBA(image.Rect(0, 0, maxDimension+1, 1)), nil), ErrTooLarge)
+	})
+}
+
+// TestEncodeRoundTrip checks the random images, sizes and options against the decoder of the standard library,
+// the error is compared with the one of its baseline encoder using the same quantization
+func TestEncodeRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(2))
+
+	for i := 0; i < 300; i++ {
+		width, height := 1+random.Intn(70), 1+random.Intn(70)
+		quality := 1 + random.Intn(100)
+		progressive := random.Intn(2) == 1
+
+		var img image.Image
+		switch random.Intn(3) {
+		case 0:
+			img = randomImage(random, width, height)
+		case 1:
+			img = gradientImage(width, height)
+		default:
+			img = solidImage(width, height, color.NRGBA{
+				R: uint8(random.Intn(256)), G: uint8(random.Intn(256)), B: uint8(random.Intn(256)), A: 255,
+			})
+		}
+
+		var buf, standard bytes.Buffer
+		require.NoError(t, Encode(&buf, img, &Options{Quality: quality, Progressive: progressive}))
+		require.NoError(t, stdjpeg.Encode(&standard, img, &stdjpeg.Options{Quality: quality}))
+
+		decoded, err := stdjpeg.Decode(&buf)
+		require.NoError(t, err, "%dx%d q%d progressive %v", width, height, quality, progressive)
+		require.Equal(t, img.Bounds().Size(), decoded.Bounds().Size())
+
+		decodedStandard, err := stdjpeg.Decode(&standard)
+		require.NoError(t, err)
+		require.LessOrEqual(t, meanError(img, decoded), meanError(img, decodedStandard)+1.5)
+	}
+}
+
+func meanError(expected, actual image.Image) float64 {
+	eb, ab := expected.Bounds(), actual.Bounds()
+
+	sum := 0.0
+	for y := 0; y < eb.Dy(); y++ {
+		for x := 0; x < eb.Dx(); x++ {
+			er, eg, ebl, _ := expected.At(eb.Min.X+x, eb.Min.Y+y).RGBA()
+			ar, ag, abl, _ := actual.At(ab.Min.X+x, ab.Min.Y+y).RGBA()
+
+			sum += math.Abs(float64(er>>8) - float64(ar>>8))
+			sum += math.Abs(float64(eg>>8) - float64(ag>>8))
+			sum += math.Abs(float64(ebl>>8) - float64(abl>>8))
+		}
+	}
+
+	return sum / float64(3*eb.Dx()*eb.Dy())
+}
+
+func solidImage(width, height int, c color.NRGBA) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	return img
+}
+
+func gradientImage(width, height int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y * 2), B: uint8(x + y), A: 255})
+		}
+	}
+
+	return img
+}
+
+func randomImage(random *rand.Rand, width, height int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(random.Intn(256)),
+				G: uint8(random.Intn(256)),
+				B: uint8(random.Intn(256)),
+				A: 255,
+			})
+		}
+	}
+
+	return img
+}
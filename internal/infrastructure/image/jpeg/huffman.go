@@ -0,0 +1,65 @@
+package jpeg
+
+import (
+	"sort"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/infrastructure/image/huffman"
+)
+
+const (
+	maxCodeLength = 16
+	// reservedSymbol takes the all ones code, which JPEG does not allow
+	reservedSymbol = 256
+)
+
+type huffmanTable struct {
+	counts  [reservedSymbol + 1]uint32
+	codes   [reservedSymbol]uint16
+	lengths [reservedSymbol]uint8
+}
+
+// build calculates the optimal code lengths and returns the table in the DHT form:
+// the number of the codes of each length followed by the symbols.
+func (t *huffmanTable) build() []byte {
+	counts := t.counts
+	counts[reservedSymbol] = 1
+
+	lengths := huffman.Lengths(counts[:], maxCodeLength)
+
+	// the reserved symbol must be the last one among the longest codes
+	longest := reservedSymbol
+	for symbol, length := range lengths {
+		if length > lengths[longest] {
+			longest = symbol
+		}
+	}
+	lengths[longest], lengths[reservedSymbol] = lengths[reservedSymbol], lengths[longest]
+
+	var symbols []int
+	for symbol := 0; symbol < reservedSymbol; symbol++ {
+		if lengths[symbol] > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+
+	sort.SliceStable(symbols, func(i, j int) bool {
+		return lengths[symbols[i]] < lengths[symbols[j]]
+	})
+
+	table := make([]byte, maxCodeLength, maxCodeLength+len(symbols))
+
+	code, length := uint16(0), uint8(1)
+	for _, symbol := range symbols {
+		for ; length < lengths[symbol]; length++ {
+			code <<= 1
+		}
+
+		t.codes[symbol], t.lengths[symbol] = code, length
+		code++
+
+		table[length-1]++
+		table = append(table, byte(symbol))
+	}
+
+	return table
+}
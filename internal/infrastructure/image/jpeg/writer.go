@@ -0,0 +1,120 @@
+package jpeg
+
+const (
+	markerSOI  = 0xd8
+	markerEOI  = 0xd9
+	markerSOF0 = 0xc0
+	markerSOF2 = 0xc2
+	markerDHT  = 0xc4
+	markerDQT  = 0xdb
+	markerSOS  = 0xda
+)
+
+var componentIDs = [3]byte{1, 2, 3}
+
+func (e *encoder) writeMarker(marker byte, payload []byte) {
+	e.write([]byte{0xff, marker})
+
+	if payload != nil {
+		length := len(payload) + 2
+		e.write([]byte{byte(length >> 8), byte(length)})
+		e.write(payload)
+	}
+}
+
+func (e *encoder) writeDQT() {
+	payload := make([]byte, 0, 2*(1+blockSize))
+	for i, quant := range e.quant {
+		payload = append(payload, byte(i))
+		for _, q := range quant {
+			payload = append(payload, byte(q))
+		}
+	}
+
+	e.writeMarker(markerDQT, payload)
+}
+
+func (e *encoder) writeSOF(marker byte) {
+	payload := []byte{
+		8,
+		byte(e.height >> 8), byte(e.height),
+		byte(e.width >> 8), byte(e.width),
+		3,
+	}
+
+	for c, id := range componentIDs {
+		// the luma is sampled 2x2, the chroma 1x1
+		sampling := byte(0x11)
+		if c == 0 {
+			sampling = 0x22
+		}
+		payload = append(payload, id, sampling, byte(e.components[c].quant))
+	}
+
+	e.writeMarker(marker, payload)
+}
+
+func (e *encoder) writeDHT(s scan) {
+	var payload []byte
+
+	used := make(map[*huffmanTable]bool)
+	for _, c := range s.components {
+		if s.ss == 0 {
+			if t := e.dcTable(c); !used[e.dc[t]] {
+				used[e.dc[t]] = true
+				payload = append(payload, byte(t))
+				payload = append(payload, e.dc[t].build()...)
+			}
+		}
+
+		if s.se > 0 {
+			if t := e.acTable(s, c); !used[e.ac[t]] {
+				used[e.ac[t]] = true
+				payload = append(payload, 0x10|byte(t))
+				payload = append(payload, e.ac[t].build()...)
+			}
+		}
+	}
+
+	e.writeMarker(markerDHT, payload)
+}
+
+func (e *encoder) writeSOS(s scan) {
+	payload := []byte{byte(len(s.components))}
+	for _, c := range s.components {
+		payload = append(payload, componentIDs[c], byte(e.dcTable(c)<<4|e.acTable(s, c)))
+	}
+	payload = append(payload, byte(s.ss), byte(s.se), 0)
+
+	e.writeMarker(markerSOS, payload)
+}
+
+// bitWriter writes the entropy coded data starting from the most significant bit
+type bitWriter struct {
+	w     *encoder
+	acc   uint32
+	nbits int
+}
+
+func (b *bitWriter) writeBits(bits uint32, n int) {
+	b.acc = b.acc<<uint(n) | bits
+	b.nbits += n
+
+	for b.nbits >= 8 {
+		c := byte(b.acc >> uint(b.nbits-8))
+		b.w.writeByte(c)
+		if c == 0xff {
+			// stuffing, so the data is not taken for a marker
+			b.w.writeByte(0)
+		}
+		b.nbits -= 8
+	}
+}
+
+// flush pads the last byte with ones
+func (b *bitWriter) flush() {
+	if b.nbits > 0 {
+		b.writeBits(1<<uint(8-b.nbits)-1, 8-b.nbits)
+	}
+	b.acc = 0
+}
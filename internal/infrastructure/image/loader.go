@@ -3,71 +3,213 @@ package internalimage
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"image"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+	"github.com/alexandr-lakeev/otus-final-project/internal/config"
 )
 
 var statusCodeToError = map[int]error{
 	http.StatusBadRequest:          app.ErrBadRequest,
 	http.StatusNotFound:            app.ErrImageNotFound,
+	http.StatusGone:                app.ErrImageNotFound,
 	http.StatusInternalServerError: app.ErrInternal,
+	http.StatusGatewayTimeout:      app.ErrTimeout,
 	// TODO add more if needed
 }
 
+// fallbackSchemes are tried when the request to the default scheme fails to connect
+var fallbackSchemes = map[string]string{
+	"https": "http",
+	"http":  "https",
+}
+
 type ImageLoader struct {
-	client *http.Client
+	client          *http.Client
+	defaultScheme   string
+	schemeFallback  bool
+	maxBodyBytes    int64
+	maxSourcePixels int64
+	defaultTTL      time.Duration
+	maxTTL          time.Duration
+	retry           config.RetryConf
+	breaker         *circuitBreaker
+	headers         *headerPolicy
 }
 
-func NewLoader(client *http.Client) *ImageLoader {
+func NewLoader(client *http.Client, cfg config.LoaderConf) *ImageLoader {
+	defaultScheme := cfg.DefaultScheme
+	if defaultScheme == "" {
+		defaultScheme = "http"
+	}
+
 	return &ImageLoader{
-		client: client,
+		client:          client,
+		defaultScheme:   defaultScheme,
+		schemeFallback:  cfg.SchemeFallback,
+		maxBodyBytes:    cfg.MaxBodyBytes,
+		maxSourcePixels: cfg.MaxSourcePixels,
+		defaultTTL:      cfg.DefaultTTL,
+		maxTTL:          cfg.MaxTTL,
+		retry:           cfg.Retry,
+		breaker:         newCircuitBreaker(cfg.Breaker.FailureThreshold, cfg.Breaker.OpenTimeout),
+		headers:         newHeaderPolicy(cfg.Headers),
 	}
 }
 
-func (l *ImageLoader) Load(ctx context.Context, uri string, headers http.Header) (image.Image, error) {
-	parsedUrl, err := url.Parse(uri)
+func (l *ImageLoader) Load(ctx context.Context, request *app.LoadRequest) (*app.LoadedImage, error) {
+	parsedUrl, err := url.Parse(request.Url)
 	if err != nil {
 		return nil, err
 	}
 
-	parsedUrl.Scheme = "http"
-	req, err := http.NewRequestWithContext(ctx, "GET", parsedUrl.String(), nil)
+	if parsedUrl.Scheme != "" {
+		if _, ok := fallbackSchemes[parsedUrl.Scheme]; !ok {
+			return nil, app.ErrUnsupportedScheme
+		}
+
+		return l.load(ctx, parsedUrl, request)
+	}
+
+	parsedUrl.Scheme = l.defaultScheme
+	loaded, err := l.load(ctx, parsedUrl, request)
+
+	// only an origin not listening on the scheme is retried with the other one, a failed handshake is never downgraded
+	var connErr *connectionError
+	if l.schemeFallback && errors.As(err, &connErr) && connErr.dial && !errors.Is(err, app.ErrForbiddenHost) && ctx.Err() == nil {
+		parsedUrl.Scheme = fallbackSchemes[l.defaultScheme]
+		return l.load(ctx, parsedUrl, request)
+	}
+
+	return loaded, err
+}
+
+// load retries the transient failures, the host failing in a row is not requested until the breaker lets it
+func (l *ImageLoader) load(ctx context.Context, parsedUrl *url.URL, request *app.LoadRequest) (*app.LoadedImage, error) {
+	for attempt := 1; ; attempt++ {
+		if err := l.breaker.Allow(parsedUrl.Host, time.Now()); err != nil {
+			return nil, err
+		}
+
+		loaded, err := l.fetch(ctx, parsedUrl.String(), request)
+
+		l.breaker.Report(parsedUrl.Host, l.outcome(ctx, err), time.Now())
+
+		if err == nil || attempt >= l.retry.Attempts || !isTransient(err) || ctx.Err() != nil {
+			return loaded, err
+		}
+
+		if err := sleep(ctx, backoff(attempt, l.retry.BaseDelay, l.retry.MaxDelay)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (l *ImageLoader) outcome(ctx context.Context, err error) breakerOutcome {
+	switch {
+	case ctx.Err() != nil:
+		return outcomeUnknown
+	case isTransient(err):
+		return outcomeFailure
+	default:
+		return outcomeSuccess
+	}
+}
+
+func (l *ImageLoader) fetch(ctx context.Context, uri string, request *app.LoadRequest) (*app.LoadedImage, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header = headers
+	req.Header = l.requestHeaders(ctx, request)
 
 	response, err := l.client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, &connectionError{err: wrapTimeout(err), dial: isDialError(err)}
 	}
 	defer response.Body.Close()
 
+	origin := l.origin(response.Header, time.Now())
+
+	if previous := request.Previous; response.StatusCode == http.StatusNotModified && previous != nil {
+		// the validators may be omitted from 304, they have not changed then
+		if origin.ETag == "" {
+			origin.ETag = previous.ETag
+		}
+		if origin.LastModified == "" {
+			origin.LastModified = previous.LastModified
+		}
+
+		return &app.LoadedImage{Origin: origin, NotModified: true}, nil
+	}
+
 	if err := l.resolveStatusCode(response.StatusCode); err != nil {
 		return nil, err
 	}
 
-	body, err := io.ReadAll(response.Body)
+	body, err := l.readBody(response)
+	if err != nil {
+		return nil, wrapTimeout(err)
+	}
+
+	img, err := decodeImage(body, l.maxSourcePixels)
 	if err != nil {
 		return nil, err
 	}
 
-	if !l.isImage(body) {
-		return nil, app.ErrContentNotImage
+	return &app.LoadedImage{Image: img, Origin: origin}, nil
+}
+
+func (l *ImageLoader) requestHeaders(ctx context.Context, request *app.LoadRequest) http.Header {
+	clientIP, _ := ctx.Value(app.ClientIPContextKey).(string)
+	requestHeaders := l.headers.apply(request.Headers, clientIP)
+
+	for name, values := range request.OriginHeaders {
+		requestHeaders[name] = append([]string(nil), values...)
 	}
 
-	img, _, err := image.Decode(bytes.NewReader(body))
+	if previous := request.Previous; previous != nil {
+		if previous.ETag != "" {
+			requestHeaders.Set("If-None-Match", previous.ETag)
+		}
+		if previous.LastModified != "" {
+			requestHeaders.Set("If-Modified-Since", previous.LastModified)
+		}
+	}
 
-	return img, err
+	return requestHeaders
 }
 
-func (l *ImageLoader) isImage(body []byte) bool {
-	return strings.Split(http.DetectContentType(body), "/")[0] == "image"
+// origin reads the caching metadata of the response, the freshness is limited by the configured TTLs
+func (l *ImageLoader) origin(header http.Header, now time.Time) app.Origin {
+	ttl, ok := freshness(header, now)
+	if !ok {
+		ttl = l.defaultTTL
+	}
+
+	return app.Origin{
+		ETag:           header.Get("ETag"),
+		LastModified:   header.Get("Last-Modified"),
+		Expires:        now.Add(limitTTL(ttl, l.maxTTL)),
+		NoStore:        noStore(header),
+		MustRevalidate: mustRevalidate(header),
+	}
+}
+
+func (l *ImageLoader) readBody(response *http.Response) ([]byte, error) {
+	if l.maxBodyBytes > 0 && response.ContentLength > l.maxBodyBytes {
+		return nil, app.ErrImageTooLarge
+	}
+
+	return readLimited(response.Body, l.maxBodyBytes)
 }
 
 func (l *ImageLoader) resolveStatusCode(statusCode int) error {
@@ -76,9 +218,115 @@ func (l *ImageLoader) resolveStatusCode(statusCode int) error {
 	}
 
 	err, ok := statusCodeToError[statusCode]
-	if ok {
-		return err
+	if !ok {
+		err = app.ErrUnknown
+	}
+
+	return &statusError{statusCode: statusCode, err: err}
+}
+
+func limitTTL(ttl, maxTTL time.Duration) time.Duration {
+	if maxTTL > 0 && ttl > maxTTL {
+		return maxTTL
+	}
+
+	return ttl
+}
+
+// readLimited reads the whole image, a non-positive limit reads it without the limit
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
 	}
 
-	return app.ErrUnknown
+	if int64(len(body)) > limit {
+		return nil, app.ErrImageTooLarge
+	}
+
+	return body, nil
+}
+
+func decodeImage(body []byte, maxSourcePixels int64) (image.Image, error) {
+	if !isImage(body) {
+		return nil, app.ErrContentNotImage
+	}
+
+	// a small file may declare huge dimensions, so they are checked before allocating the pixels
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return nil, wrapDecodeError(err)
+	}
+
+	if maxSourcePixels > 0 && int64(imgConfig.Width)*int64(imgConfig.Height) > maxSourcePixels {
+		return nil, app.ErrImageDimensionsTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, wrapDecodeError(err)
+	}
+
+	return img, nil
+}
+
+func isImage(body []byte) bool {
+	return strings.Split(http.DetectContentType(body), "/")[0] == "image"
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func wrapTimeout(err error) error {
+	var netErr net.Error
+	if (errors.As(err, &netErr) && netErr.Timeout()) || errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s", app.ErrTimeout, err)
+	}
+
+	return err
+}
+
+// wrapDecodeError tells an image of an unknown format from a broken one
+func wrapDecodeError(err error) error {
+	if errors.Is(err, image.ErrFormat) {
+		return fmt.Errorf("%w: %s", app.ErrContentNotImage, err)
+	}
+
+	return fmt.Errorf("%w: %s", app.ErrCorruptImage, err)
+}
+
+// statusError keeps the status code of the failed response
+type statusError struct {
+	statusCode int
+	err        error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// connectionError marks the errors occurred before the origin responded
+type connectionError struct {
+	err error
+	// dial is set when the connection has not been established
+	dial bool
+}
+
+func (e *connectionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *connectionError) Unwrap() error {
+	return e.err
 }
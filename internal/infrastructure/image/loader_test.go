@@ -0,0 +1,337 @@
+package internalimage
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"image"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+	"github.com/alexandr-lakeev/otus-final-project/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// flappingOrigin fails the requests while the status is not 200
+type flappingOrigin struct {
+	*httptest.Server
+	requests int32
+	status   int32
+	// failures is the number of the next requests to fail with the status, negative means all of them
+	failures int32
+}
+
+func newFlappingOrigin() *flappingOrigin {
+	origin := &flappingOrigin{}
+	origin.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&origin.requests, 1)
+
+		if failures := atomic.LoadInt32(&origin.failures); failures != 0 {
+			atomic.AddInt32(&origin.failures, -1)
+			w.WriteHeader(int(atomic.LoadInt32(&origin.status)))
+			return
+		}
+
+		png.Encode(w, image.NewNRGBA(image.Rect(0, 0, 10, 10)))
+	}))
+
+	return origin
+}
+
+func (o *flappingOrigin) fail(status, failures int) {
+	atomic.StoreInt32(&o.status, int32(status))
+	atomic.StoreInt32(&o.failures, int32(failures))
+}
+
+func (o *flappingOrigin) requestCount() int {
+	return int(atomic.SwapInt32(&o.requests, 0))
+}
+
+func TestLoaderRetries(t *testing.T) {
+	origin := newFlappingOrigin()
+	defer origin.Close()
+
+	loader := NewLoader(&http.Client{Timeout: time.Second}, config.LoaderConf{
+		Retry: config.RetryConf{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond},
+	})
+
+	tests := []struct {
+		name     string
+		status   int
+		failures int
+		err      error
+		requests int
+	}{
+		{name: "transient failures", status: http.StatusServiceUnavailable, failures: 2, requests: 3},
+		{name: "retries exhausted", status: http.StatusInternalServerError, failures: 3, err: app.ErrInternal, requests: 3},
+		{name: "gateway timeout", status: http.StatusGatewayTimeout, failures: 1, requests: 2},
+		{name: "not found is not retried", status: http.StatusNotFound, failures: 1, err: app.ErrImageNotFound, requests: 1},
+		{name: "bad request is not retried", status: http.StatusBadRequest, failures: 1, err: app.ErrBadRequest, requests: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origin.fail(tt.status, tt.failures)
+			defer origin.fail(0, 0)
+
+			loaded, err := loader.Load(context.Background(), &app.LoadRequest{Url: origin.URL + "/img.png"})
+			require.Equal(t, tt.requests, origin.requestCount())
+
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, 10, loaded.Image.Bounds().Dx())
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		var requests int32
+		slowOrigin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			<-r.Context().Done()
+		}))
+		defer slowOrigin.Close()
+
+		loader := NewLoader(&http.Client{Timeout: 20 * time.Millisecond}, config.LoaderConf{
+			Retry: config.RetryConf{Attempts: 2, BaseDelay: time.Millisecond},
+		})
+
+		_, err := loader.Load(context.Background(), &app.LoadRequest{Url: slowOrigin.URL + "/img.png"})
+		require.ErrorIs(t, err, app.ErrTimeout)
+		require.EqualValues(t, 2, atomic.LoadInt32(&requests))
+	})
+
+	t.Run("cancelled during backoff", func(t *testing.T) {
+		origin.fail(http.StatusServiceUnavailable, -1)
+		defer origin.fail(0, 0)
+
+		loader := NewLoader(&http.Client{Timeout: time.Second}, config.LoaderConf{
+			Retry: config.RetryConf{Attempts: 3, BaseDelay: time.Hour},
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		_, err := loader.Load(ctx, &app.LoadRequest{Url: origin.URL + "/img.png"})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Equal(t, 1, origin.requestCount())
+	})
+}
+
+func TestLoaderBreaker(t *testing.T) {
+	const openTimeout = 50 * time.Millisecond
+
+	newLoader := func() *ImageLoader {
+		return NewLoader(&http.Client{Timeout: time.Second}, config.LoaderConf{
+			Breaker: config.BreakerConf{FailureThreshold: 3, OpenTimeout: openTimeout},
+		})
+	}
+
+	t.Run("opens and closes", func(t *testing.T) {
+		origin := newFlappingOrigin()
+		defer origin.Close()
+		loader := newLoader()
+
+		origin.fail(http.StatusBadGateway, -1)
+		for i := 0; i < 3; i++ {
+			_, err := loader.Load(context.Background(), &app.LoadRequest{Url: origin.URL + "/img.png"})
+			require.ErrorIs(t, err, app.ErrUnknown)
+		}
+		require.Equal(t, 3, origin.requestCount())
+
+		// open: fails fast without a request
+		_, err := loader.Load(context.Background(), &app.LoadRequest{Url: origin.URL + "/img.png"})
+		require.ErrorIs(t, err, app.ErrOriginUnavailable)
+		require.Equal(t, 0, origin.requestCount())
+
+		// half-open: the failed trial opens it again
+		time.Sleep(openTimeout)
+		_, err = loader.Load(context.Background(), &app.LoadRequest{Url: origin.URL + "/img.png"})
+		require.ErrorIs(t, err, app.ErrUnknown)
+		require.Equal(t, 1, origin.requestCount())
+
+		_, err = loader.Load(context.Background(), &app.LoadRequest{Url: origin.URL + "/img.png"})
+		require.ErrorIs(t, err, app.ErrOriginUnavailable)
+
+		// half-open: the successful trial closes it
+		origin.fail(0, 0)
+		time.Sleep(openTimeout)
+		for i := 0; i < 3; i++ {
+			_, err = loader.Load(context.Background(), &app.LoadRequest{Url: origin.URL + "/img.png"})
+			require.NoError(t, err)
+		}
+		require.Equal(t, 3, origin.requestCount())
+	})
+
+	t.Run("hosts are independent", func(t *testing.T) {
+		origin := newFlappingOrigin()
+		defer origin.Close()
+		healthy := newFlappingOrigin()
+		defer healthy.Close()
+		loader := newLoader()
+
+		origin.fail(http.StatusServiceUnavailable, -1)
+		for i := 0; i < 4; i++ {
+			loader.Load(context.Background(), &app.LoadRequest{Url: origin.URL + "/img.png"})
+		}
+
+		_, err := loader.Load(context.Background(), &app.LoadRequest{Url: origin.URL + "/img.png"})
+		require.ErrorIs(t, err, app.ErrOriginUnavailable)
+
+		_, err = loader.Load(context.Background(), &app.LoadRequest{Url: healthy.URL + "/img.png"})
+		require.NoError(t, err)
+	})
+
+	t.Run("client errors do not open it", func(t *testing.T) {
+		origin := newFlappingOrigin()
+		defer origin.Close()
+		loader := newLoader()
+
+		origin.fail(http.StatusNotFound, 5)
+		for i := 0; i < 5; i++ {
+			_, err := loader.Load(context.Background(), &app.LoadRequest{Url: origin.URL + "/img.png"})
+			require.ErrorIs(t, err, app.ErrImageNotFound)
+		}
+
+		_, err := loader.Load(context.Background(), &app.LoadRequest{Url: origin.URL + "/img.png"})
+		require.NoError(t, err)
+	})
+
+	t.Run("unknown host does not open it", func(t *testing.T) {
+		var requests int32
+		loader := NewLoader(&http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+			atomic.AddInt32(&requests, 1)
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "missing.test", IsNotFound: true}}
+		})}, config.LoaderConf{
+			Retry:   config.RetryConf{Attempts: 3, BaseDelay: time.Millisecond},
+			Breaker: config.BreakerConf{FailureThreshold: 1, OpenTimeout: time.Hour},
+		})
+
+		for i := 0; i < 3; i++ {
+			_, err := loader.Load(context.Background(), &app.LoadRequest{Url: "http://missing.test/img.png"})
+			require.Error(t, err)
+			require.NotErrorIs(t, err, app.ErrOriginUnavailable)
+		}
+		require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("idle hosts are forgotten", func(t *testing.T) {
+		breaker := newCircuitBreaker(3, openTimeout)
+		now := time.Now()
+
+		for i := 0; i < 100; i++ {
+			breaker.Report(fmt.Sprintf("host%d", i), outcomeFailure, now)
+		}
+		require.Len(t, breaker.hosts, 100)
+
+		breaker.Report("other", outcomeFailure, now.Add(openTimeout+breakerGrace))
+		require.Len(t, breaker.hosts, 1)
+		require.Contains(t, breaker.hosts, "other")
+	})
+
+	t.Run("flapping origin", func(t *testing.T) {
+		origin := newFlappingOrigin()
+		defer origin.Close()
+
+		// every other request fails, the retries hide it and the breaker stays closed
+		loader := NewLoader(&http.Client{Timeout: time.Second}, config.LoaderConf{
+			Retry:   config.RetryConf{Attempts: 2, BaseDelay: time.Millisecond},
+			Breaker: config.BreakerConf{FailureThreshold: 2, OpenTimeout: time.Hour},
+		})
+
+		for i := 0; i < 10; i++ {
+			origin.fail(http.StatusServiceUnavailable, 1)
+			_, err := loader.Load(context.Background(), &app.LoadRequest{Url: origin.URL + "/img.png"})
+			require.NoError(t, err)
+		}
+		require.Equal(t, 20, origin.requestCount())
+	})
+}
+
+func TestLoaderTLS(t *testing.T) {
+	t.Run("untrusted certificate is not retried", func(t *testing.T) {
+		var handshakes int32
+		origin := httptest.NewUnstartedServer(http.NotFoundHandler())
+		origin.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&handshakes, 1)
+			}
+		}
+		origin.StartTLS()
+		defer origin.Close()
+
+		loader := NewLoader(&http.Client{Timeout: time.Second}, config.LoaderConf{
+			Retry:   config.RetryConf{Attempts: 3, BaseDelay: time.Millisecond},
+			Breaker: config.BreakerConf{FailureThreshold: 1, OpenTimeout: time.Hour},
+		})
+
+		for i := 0; i < 2; i++ {
+			_, err := loader.Load(context.Background(), &app.LoadRequest{Url: origin.URL + "/img.png"})
+
+			// the breaker stays closed
+			var unknownAuthority x509.UnknownAuthorityError
+			require.ErrorAs(t, err, &unknownAuthority)
+		}
+		require.Equal(t, int32(2), atomic.LoadInt32(&handshakes))
+	})
+
+	t.Run("scheme fallback", func(t *testing.T) {
+		origin := newFlappingOrigin()
+		defer origin.Close()
+
+		hostUrl := "//" + strings.TrimPrefix(origin.URL, "http://") + "/img.png"
+
+		// nothing listens on the https port
+		refused := &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+			},
+		}
+		loader := NewLoader(&http.Client{Timeout: time.Second, Transport: refused}, config.LoaderConf{
+			DefaultScheme:  "https",
+			SchemeFallback: true,
+		})
+
+		loaded, err := loader.Load(context.Background(), &app.LoadRequest{Url: hostUrl})
+		require.NoError(t, err)
+		require.Equal(t, 10, loaded.Image.Bounds().Dx())
+		require.Equal(t, 1, origin.requestCount())
+
+		// the handshake with the plain http origin fails after the connection, the request is not downgraded
+		loader = NewLoader(&http.Client{Timeout: time.Second}, config.LoaderConf{
+			DefaultScheme:  "https",
+			SchemeFallback: true,
+		})
+
+		_, err = loader.Load(context.Background(), &app.LoadRequest{Url: hostUrl})
+		require.Error(t, err)
+		require.Equal(t, 0, origin.requestCount())
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, limit := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		delay := backoff(attempt+1, 100, 1000)
+		require.GreaterOrEqual(t, int64(delay), int64(limit/2))
+		require.LessOrEqual(t, int64(delay), int64(limit))
+	}
+
+	require.Zero(t, backoff(1, 0, 0))
+}
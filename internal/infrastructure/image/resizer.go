@@ -2,6 +2,7 @@ package internalimage
 
 import (
 	"image"
+	"image/color"
 
 	"github.com/disintegration/imaging"
 )
@@ -16,3 +17,25 @@ func NewResizer() *ImageResizer {
 func (r *ImageResizer) Fill(img image.Image, width, height int) image.Image {
 	return imaging.Fill(img, width, height, imaging.Center, imaging.Lanczos)
 }
+
+func (r *ImageResizer) Fit(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+
+	if width == 0 {
+		width = bounds.Dx()
+	}
+
+	if height == 0 {
+		height = bounds.Dy()
+	}
+
+	return imaging.Fit(img, width, height, imaging.Lanczos)
+}
+
+func (r *ImageResizer) Pad(img image.Image, width, height int, background color.Color) image.Image {
+	return imaging.PasteCenter(imaging.New(width, height, background), r.Fit(img, width, height))
+}
+
+func (r *ImageResizer) Resize(img image.Image, width, height int) image.Image {
+	return imaging.Resize(img, width, height, imaging.Lanczos)
+}
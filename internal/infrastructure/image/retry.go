@@ -0,0 +1,85 @@
+package internalimage
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+)
+
+// transientStatusCodes are the responses of an overloaded or restarting origin
+var transientStatusCodes = map[int]bool{
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// isTransient reports whether the failure may go away on the next attempt
+func isTransient(err error) bool {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return transientStatusCodes[statusErr.statusCode]
+	}
+
+	var connErr *connectionError
+	if errors.As(err, &connErr) {
+		return !errors.Is(err, app.ErrForbiddenHost) && !errors.Is(err, context.Canceled) &&
+			!isCertificateError(err) && !isUnknownHost(err)
+	}
+
+	return errors.Is(err, app.ErrTimeout)
+}
+
+// isCertificateError reports the rejected certificate of the origin, it fails the same way on every attempt
+func isCertificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname)
+}
+
+// isUnknownHost reports the host missing in DNS, it is not a failure of the host
+func isUnknownHost(err error) bool {
+	var dnsErr *net.DNSError
+
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// backoff is the exponential delay before the attempt following the given one, the upper half of it is random
+func backoff(attempt int, baseDelay, maxDelay time.Duration) time.Duration {
+	delay := baseDelay
+	for i := 1; i < attempt && (maxDelay <= 0 || delay < maxDelay); i++ {
+		delay *= 2
+	}
+
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1)) //nolint:gosec // no need for a secure random
+}
+
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,261 @@
+package internalimage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+	"github.com/alexandr-lakeev/otus-final-project/internal/config"
+)
+
+// emptyPayloadHash is the SHA-256 of the empty body of GET
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// unsignedHeaders may be changed on the way to the store
+var unsignedHeaders = map[string]bool{
+	"authorization":   true,
+	"user-agent":      true,
+	"x-amzn-trace-id": true,
+	"expect":          true,
+	"via":             true,
+	"x-forwarded-for": true,
+}
+
+// ObjectLoader loads the objects of the S3 compatible store by s3://{bucket}/{key} urls.
+// The store is requested like any other origin, so the freshness, revalidation, retries and the breaker apply,
+// but the endpoint is trusted and the access policy of the origins does not restrict it.
+// The requests are signed with the credentials of the previewer, so they carry none of the client headers
+// and do not follow the redirects.
+type ObjectLoader struct {
+	loader    *ImageLoader
+	endpoint  *url.URL
+	pathStyle bool
+}
+
+func NewObjectLoader(timeout time.Duration, cfg config.LoaderConf) (*ObjectLoader, error) {
+	endpoint, err := url.Parse(cfg.S3.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	trusted := cfg
+	trusted.Access = config.AccessConf{}
+	trusted.Headers = config.HeadersConf{}
+
+	client, err := NewHTTPClient(timeout, trusted)
+	if err != nil {
+		return nil, err
+	}
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	if cfg.S3.AccessKey != "" {
+		client.Transport = &signingTransport{
+			next:   client.Transport,
+			signer: newS3Signer(cfg.S3),
+		}
+	}
+
+	return &ObjectLoader{
+		loader:    NewLoader(client, trusted),
+		endpoint:  endpoint,
+		pathStyle: cfg.S3.PathStyle,
+	}, nil
+}
+
+func (l *ObjectLoader) Load(ctx context.Context, request *app.LoadRequest) (*app.LoadedImage, error) {
+	parsedUrl, err := url.Parse(request.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsedUrl.Scheme != "s3" {
+		return nil, app.ErrUnsupportedScheme
+	}
+
+	bucket, key := parsedUrl.Host, strings.TrimPrefix(parsedUrl.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, app.ErrImageNotFound
+	}
+
+	objectRequest := *request
+	objectRequest.Url = l.objectURL(bucket, key).String()
+	objectRequest.Headers = nil
+
+	return l.loader.Load(ctx, &objectRequest)
+}
+
+func (l *ObjectLoader) objectURL(bucket, key string) *url.URL {
+	objectURL := *l.endpoint
+	objectPath := strings.TrimSuffix(objectURL.Path, "/")
+
+	if l.pathStyle {
+		objectPath += "/" + bucket
+	} else {
+		objectURL.Host = bucket + "." + objectURL.Host
+	}
+
+	objectURL.Path = objectPath + "/" + key
+	// the path is sent as it is signed
+	objectURL.RawPath = s3Escape(objectURL.Path, false)
+
+	return &objectURL
+}
+
+// signingTransport signs every request including the redirected ones
+type signingTransport struct {
+	next   http.RoundTripper
+	signer *s3Signer
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the round tripper must not modify the request
+	req = req.Clone(req.Context())
+	t.signer.sign(req, time.Now())
+
+	return t.next.RoundTrip(req)
+}
+
+// s3Signer signs the requests without body with AWS Signature Version 4
+type s3Signer struct {
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func newS3Signer(cfg config.S3Conf) *s3Signer {
+	return &s3Signer{
+		region:       cfg.Region,
+		accessKey:    cfg.AccessKey,
+		secretKey:    cfg.SecretKey,
+		sessionToken: cfg.SessionToken,
+	}
+}
+
+func (s *s3Signer) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + s.region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	signedHeaders, canonicalHeaders := s.canonicalHeaders(req)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s.canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hashHex(canonicalRequest),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), amzDate[:8])
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 "+
+		"Credential="+s.accessKey+"/"+scope+", "+
+		"SignedHeaders="+signedHeaders+", "+
+		"Signature="+hex.EncodeToString(hmacSHA256(key, stringToSign)))
+}
+
+func (s *s3Signer) canonicalHeaders(req *http.Request) (string, string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	values := map[string]string{"host": host}
+	for name, headerValues := range req.Header {
+		name = strings.ToLower(name)
+		if unsignedHeaders[name] {
+			continue
+		}
+
+		trimmed := make([]string, 0, len(headerValues))
+		for _, value := range headerValues {
+			trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+		}
+		values[name] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + values[name] + "\n")
+	}
+
+	return strings.Join(names, ";"), canonical.String()
+}
+
+func (s *s3Signer) canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape encodes all but the unreserved characters, the slashes are kept in the paths only
+func s3Escape(value string, escapeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			escaped.WriteByte(c)
+		default:
+			escaped.WriteByte('%')
+			escaped.WriteByte(hexDigits[c>>4])
+			escaped.WriteByte(hexDigits[c&15])
+		}
+	}
+
+	return escaped.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+func hashHex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,58 @@
+package internalimage
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+	"github.com/alexandr-lakeev/otus-final-project/internal/config"
+)
+
+// SchemeLoader picks the loader of the image by the scheme of its url, the other urls go to the fallback one
+type SchemeLoader struct {
+	fallback app.ImageLoader
+	loaders  map[string]app.ImageLoader
+}
+
+func NewSchemeLoader(fallback app.ImageLoader, loaders map[string]app.ImageLoader) *SchemeLoader {
+	return &SchemeLoader{
+		fallback: fallback,
+		loaders:  loaders,
+	}
+}
+
+// NewOriginLoader loads the images over HTTP and from the configured file and S3 origins
+func NewOriginLoader(timeout time.Duration, cfg config.LoaderConf) (*SchemeLoader, error) {
+	httpClient, err := NewHTTPClient(timeout, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	loaders := make(map[string]app.ImageLoader)
+
+	if cfg.File.Root != "" {
+		if loaders["file"], err = NewFileLoader(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.S3.Endpoint != "" {
+		if loaders["s3"], err = NewObjectLoader(timeout, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewSchemeLoader(NewLoader(httpClient, cfg), loaders), nil
+}
+
+func (l *SchemeLoader) Load(ctx context.Context, request *app.LoadRequest) (*app.LoadedImage, error) {
+	if parsedUrl, err := url.Parse(request.Url); err == nil {
+		if loader, ok := l.loaders[strings.ToLower(parsedUrl.Scheme)]; ok {
+			return loader.Load(ctx, request)
+		}
+	}
+
+	return l.fallback.Load(ctx, request)
+}
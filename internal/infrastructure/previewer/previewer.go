@@ -0,0 +1,82 @@
+// Package internalpreviewer sets up the use cases of the previewer out of its config
+package internalpreviewer
+
+import (
+	"fmt"
+
+	"github.com/alexandr-lakeev/otus-final-project/internal/app"
+	"github.com/alexandr-lakeev/otus-final-project/internal/app/usecase"
+	"github.com/alexandr-lakeev/otus-final-project/internal/config"
+	internalimage "github.com/alexandr-lakeev/otus-final-project/internal/infrastructure/image"
+)
+
+// NewProfileRouter sets up the use case of every origin profile, they share the cache
+func NewProfileRouter(cfg config.PreviewerConf, cache app.Cache, logger app.Logger) (*usecase.ProfileRouter, error) {
+	fallback, err := NewUseCase(cfg, cache, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]usecase.ProfileRoute, 0, len(cfg.Profiles))
+	for _, profile := range cfg.Profiles {
+		uc, err := NewUseCase(cfg.Profile(profile), cache, logger)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", profile.Name, err)
+		}
+
+		routes = append(routes, usecase.ProfileRoute{
+			Name:    profile.Name,
+			Hosts:   profile.Hosts,
+			UseCase: uc,
+		})
+	}
+
+	return usecase.NewProfileRouter(fallback, routes...), nil
+}
+
+func NewUseCase(cfg config.PreviewerConf, cache app.Cache, logger app.Logger) (*usecase.UseCase, error) {
+	loader, err := internalimage.NewOriginLoader(cfg.RequestTimeout, cfg.Loader)
+	if err != nil {
+		return nil, err
+	}
+
+	return usecase.New(
+		loader,
+		internalimage.NewResizer(),
+		internalimage.NewEncoder(cfg.Encoder),
+		cache,
+		logger,
+		useCaseOptions(cfg),
+	), nil
+}
+
+func useCaseOptions(cfg config.PreviewerConf) usecase.Options {
+	sizes := make([]usecase.Size, 0, len(cfg.Resizer.Sizes))
+	for _, allowed := range cfg.Resizer.Sizes {
+		sizes = append(sizes, usecase.Size{Width: allowed.Width, Height: allowed.Height})
+	}
+
+	presets := make(map[string]usecase.Size, len(cfg.Resizer.Presets))
+	for _, preset := range cfg.Resizer.Presets {
+		presets[preset.Name] = usecase.Size{Width: preset.Width, Height: preset.Height}
+	}
+
+	return usecase.Options{
+		Stale: usecase.StaleOptions{
+			WhileRevalidate: cfg.Stale.WhileRevalidate,
+			IfError:         cfg.Stale.IfError,
+		},
+		Failures: usecase.FailureOptions{
+			TTL:        cfg.NegativeCache.TTL,
+			MaxEntries: cfg.NegativeCache.MaxEntries,
+		},
+		Dimensions: usecase.DimensionOptions{
+			MinWidth:  cfg.Resizer.MinWidth,
+			MinHeight: cfg.Resizer.MinHeight,
+			MaxWidth:  cfg.Resizer.MaxWidth,
+			MaxHeight: cfg.Resizer.MaxHeight,
+			Sizes:     sizes,
+			Presets:   presets,
+		},
+	}
+}
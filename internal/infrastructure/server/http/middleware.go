@@ -3,6 +3,7 @@ package internalhttp
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"time"
 
@@ -27,6 +28,7 @@ func newLoggingMiddleware(logger app.Logger) func(http.Handler) http.Handler {
 			requestID := uuid.New()
 
 			ctx := context.WithValue(r.Context(), app.RequestIDContextKey, requestID)
+			ctx = context.WithValue(ctx, app.ClientIPContextKey, clientIP(r.RemoteAddr))
 			rw := &responseWriter{ResponseWriter: w}
 
 			next.ServeHTTP(rw, r.Clone(ctx))
@@ -45,3 +47,12 @@ func newLoggingMiddleware(logger app.Logger) func(http.Handler) http.Handler {
 		})
 	}
 }
+
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+
+	return host
+}
@@ -2,6 +2,7 @@ package internalhttp
 
 import (
 	"context"
+	"net"
 	"net/http"
 
 	"github.com/alexandr-lakeev/otus-final-project/internal/app"
@@ -10,12 +11,22 @@ import (
 	"github.com/gorilla/mux"
 )
 
-func NewServer(cfg config.ServerConf, usecase app.UseCase, logger app.Logger) *http.Server {
-	handler := deliveryhttp.NewHandler(usecase, logger)
+// NewServer creates the server whose requests are cancelled along with the base context
+func NewServer(ctx context.Context, cfg config.ServerConf, usecase app.UseCase, logger app.Logger) *http.Server {
+	handler := deliveryhttp.NewHandler(usecase, logger, handlerOptions(cfg))
 
 	router := mux.NewRouter()
 	router.Use(newLoggingMiddleware(logger))
-	router.PathPrefix("/fill").Handler(handler.Fill(context.Background())).Methods("GET")
+	router.PathPrefix("/fill/").Handler(handler.Fill()).Methods(http.MethodGet, http.MethodHead)
+	router.PathPrefix("/fit/").Handler(handler.Fit()).Methods(http.MethodGet, http.MethodHead)
+	router.PathPrefix("/pad/").Handler(handler.Pad()).Methods(http.MethodGet, http.MethodHead)
+	router.PathPrefix("/resize/").Handler(handler.Resize()).Methods(http.MethodGet, http.MethodHead)
+
+	if cfg.Admin.Token != "" {
+		router.PathPrefix("/admin/failures/").
+			Handler(http.StripPrefix("/admin/failures", handler.PurgeFailure())).
+			Methods(http.MethodDelete)
+	}
 
 	return &http.Server{
 		Handler:      router,
@@ -23,5 +34,33 @@ func NewServer(cfg config.ServerConf, usecase app.UseCase, logger app.Logger) *h
 		WriteTimeout: cfg.WriteTimeout,
 		ReadTimeout:  cfg.ReadTimeout,
 		IdleTimeout:  cfg.IdleTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+}
+
+func handlerOptions(cfg config.ServerConf) deliveryhttp.Options {
+	aliases := make([]deliveryhttp.AliasOptions, 0, len(cfg.Origins.Aliases))
+	for _, alias := range cfg.Origins.Aliases {
+		aliases = append(aliases, deliveryhttp.AliasOptions{
+			Name:        alias.Name,
+			BaseURL:     alias.BaseURL,
+			RewriteFrom: alias.Rewrite.From,
+			RewriteTo:   alias.Rewrite.To,
+			Headers:     alias.Headers,
+		})
+	}
+
+	return deliveryhttp.Options{
+		SignatureKeys: cfg.Signature.Keys,
+		Unsafe:        cfg.Signature.Unsafe,
+		RawURLs:       cfg.Origins.Raw,
+		Aliases:       aliases,
+		HTTPCache: deliveryhttp.HTTPCacheOptions{
+			MaxAge:     cfg.HTTPCache.MaxAge,
+			Directives: cfg.HTTPCache.Directives,
+		},
+		AdminToken: cfg.Admin.Token,
 	}
 }
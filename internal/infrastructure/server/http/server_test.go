@@ -1,12 +1,22 @@
 package internalhttp
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash/crc32"
 	"image"
 	"image/color"
 	"image/jpeg"
+	"image/png"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -14,48 +24,93 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/alexandr-lakeev/otus-final-project/internal/app"
-	"github.com/alexandr-lakeev/otus-final-project/internal/app/usecase"
 	"github.com/alexandr-lakeev/otus-final-project/internal/config"
 	internalcache "github.com/alexandr-lakeev/otus-final-project/internal/infrastructure/cache"
-	internalimage "github.com/alexandr-lakeev/otus-final-project/internal/infrastructure/image"
 	internallogger "github.com/alexandr-lakeev/otus-final-project/internal/infrastructure/logger"
+	internalpreviewer "github.com/alexandr-lakeev/otus-final-project/internal/infrastructure/previewer"
+	"github.com/alexandr-lakeev/otus-final-project/pkg/signature"
 	"github.com/stretchr/testify/require"
+	_ "golang.org/x/image/webp"
 )
 
 const TestHeader = "X-Extra-Header"
 
 var headerValue string
 
-func createServer() *http.Server {
+// proxiedHeaders are the headers of the last request to the fake origin
+var proxiedHeaders http.Header
+
+// requestedPath is the path of the last request to the fake origin
+var requestedPath string
+
+var testPreviewerConf = config.PreviewerConf{
+	RequestTimeout: time.Second,
+	CacheSize:      10,
+	Encoder: config.EncoderConf{
+		Quality:    90,
+		MinQuality: 1,
+		MaxQuality: 100,
+	},
+	Loader: config.LoaderConf{
+		DefaultTTL: time.Hour,
+	},
+}
+
+func createServer(t *testing.T) *http.Server {
+	return createServerWithConfig(t, testPreviewerConf)
+}
+
+func createServerWithConfig(t *testing.T, cfg config.PreviewerConf) *http.Server {
+	return createServerWithConfigs(t, config.ServerConf{
+		BindAddress: ":8080",
+		Signature: config.SignatureConf{
+			Unsafe: true,
+		},
+		Origins: config.OriginsConf{
+			Raw: true,
+		},
+	}, cfg)
+}
+
+func createServerWithConfigs(t *testing.T, serverCfg config.ServerConf, cfg config.PreviewerConf) *http.Server {
 	logger, err := internallogger.New(config.LoggerConf{Env: "test", Level: "INFO"})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	httpClient := &http.Client{
-		Timeout: time.Second,
+	cache, err := internalcache.NewCache(cfg.CacheSize, cfg.CacheMaxBytes, t.TempDir())
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	usecase := usecase.New(
-		internalimage.NewLoader(httpClient),
-		internalimage.NewResizer(),
-		internalcache.NewCache(10, os.TempDir()),
-		logger,
-	)
+	router, err := internalpreviewer.NewProfileRouter(cfg, cache, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	return NewServer(config.ServerConf{
-		BindAddress: ":8080",
-	}, usecase, logger)
+	return NewServer(context.Background(), serverCfg, router, logger)
 }
 
 func createFakeImageServer() *httptest.Server {
-	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return httptest.NewServer(fakeImageHandler())
+}
+
+func createFakeTLSImageServer() *httptest.Server {
+	return httptest.NewTLSServer(fakeImageHandler())
+}
+
+func fakeImageHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// store the proxied header value
 		headerValue = r.Header.Get(TestHeader)
+		proxiedHeaders = r.Header.Clone()
+		requestedPath = r.URL.Path
 
 		if r.URL.Path == "/img/success/100x100" {
 			err := jpeg.Encode(w, createTestImage(100, 100), &jpeg.Options{Quality: 100})
@@ -68,6 +123,11 @@ func createFakeImageServer() *httptest.Server {
 			return
 		}
 
+		if r.URL.Path == "/img/photo" {
+			png.Encode(w, createPhotoImage(600, 400))
+			return
+		}
+
 		if r.URL.Path == "/img/not-an-image" {
 			response := map[string]string{
 				"message": "this is not an image",
@@ -78,6 +138,24 @@ func createFakeImageServer() *httptest.Server {
 			return
 		}
 
+		if r.URL.Path == "/img/corrupt" {
+			w.Write(createBombPNG(100, 100)[:40])
+			return
+		}
+
+		if r.URL.Path == "/img/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+
+		if r.URL.Path == "/img/bomb" {
+			w.Write(createBombPNG(100000, 100000))
+			return
+		}
+
 		if r.URL.Path == "/img/error/400" {
 			w.WriteHeader(http.StatusBadRequest)
 			return
@@ -89,7 +167,37 @@ func createFakeImageServer() *httptest.Server {
 		}
 
 		w.WriteHeader(http.StatusNotFound)
-	}))
+	})
+}
+
+// createBombPNG creates the png header declaring huge dimensions without any pixel data
+func createBombPNG(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12] = 8 // bit depth
+	ihdr[13] = 2 // truecolor
+
+	png := []byte("\x89PNG\r\n\x1a\n")
+	png = append(png, 0, 0, 0, 13)
+	png = append(png, ihdr...)
+
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(ihdr))
+
+	return append(png, crc...)
+}
+
+// writeCAFile stores the certificate of the tls test server to be trusted by the loader
+func writeCAFile(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+
+	caFile := path.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, certPEM, 0o644))
+
+	return caFile
 }
 
 // create image with pattern (f = #ffffff, 0 = #000000):
@@ -121,6 +229,30 @@ func createTestImage(width, height int) *image.RGBA64 {
 	return img
 }
 
+// createPhotoImage creates the image of smooth gradients with noise, compressed like a photo
+func createPhotoImage(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	random := rand.New(rand.NewSource(1))
+
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			shade := func(base float64) uint8 {
+				value := base + float64(random.Intn(17)-8)
+				return uint8(math.Max(0, math.Min(255, value)))
+			}
+
+			img.Set(x, y, color.NRGBA{
+				R: shade(255 * float64(x) / float64(width)),
+				G: shade(127 + 100*math.Sin(float64(x+y)/40)),
+				B: shade(255 * float64(y) / float64(height)),
+				A: 0xff,
+			})
+		}
+	}
+
+	return img
+}
+
 func TestServer(t *testing.T) {
 	t.Run("headers pass", func(t *testing.T) {
 		imgServer := createFakeImageServer()
@@ -141,7 +273,7 @@ func TestServer(t *testing.T) {
 		testHeaderValue := "test"
 		req.Header.Set(TestHeader, testHeaderValue)
 
-		createServer().Handler.ServeHTTP(rec, req)
+		createServer(t).Handler.ServeHTTP(rec, req)
 
 		require.Equal(t, http.StatusOK, rec.Result().StatusCode)
 
@@ -149,145 +281,1464 @@ func TestServer(t *testing.T) {
 		require.Equal(t, testHeaderValue, headerValue)
 	})
 
-	t.Run("fill image", func(t *testing.T) {
+	t.Run("header forwarding policy", func(t *testing.T) {
+		imgServer := createFakeImageServer()
+		defer imgServer.Close()
+
+		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+		reqUrl := path.Join("/fill/50/50", imgServBaseUrl, "/img/success/100x100")
+
+		clientHeaders := map[string]string{
+			TestHeader:        "test",
+			"Cookie":          "session=secret",
+			"Authorization":   "Bearer secret",
+			"Connection":      "keep-alive, X-Hop",
+			"X-Hop":           "hop",
+			"Accept-Encoding": "br",
+			"If-None-Match":   `"preview"`,
+			"X-Forwarded-For": "203.0.113.7",
+			"Via":             "1.0 edge",
+		}
+
 		tests := []struct {
-			name   string
-			width  int
-			height int
-			imgUrl string
+			name    string
+			headers config.HeadersConf
+			want    map[string]string
 		}{
 			{
-				name:   "simple",
-				width:  50,
-				height: 50,
-				imgUrl: "/img/success/100x100",
+				name: "defaults",
+				headers: config.HeadersConf{
+					Deny:         config.DefaultDenyHeaders,
+					ForwardedFor: true,
+					Via:          "previewer",
+				},
+				want: map[string]string{
+					TestHeader:        "test",
+					"Cookie":          "",
+					"Authorization":   "",
+					"Connection":      "",
+					"X-Hop":           "",
+					"If-None-Match":   "",
+					"X-Forwarded-For": "192.0.2.1",
+					"Via":             "1.0 edge, 1.1 previewer",
+				},
 			},
 			{
-				name:   "only width",
-				width:  50,
-				height: 100,
-				imgUrl: "/img/success/100x100",
+				name:    "hop-by-hop headers are always dropped",
+				headers: config.HeadersConf{},
+				want: map[string]string{
+					TestHeader:        "test",
+					"Cookie":          "session=secret",
+					"X-Hop":           "",
+					"If-None-Match":   "",
+					"X-Forwarded-For": "203.0.113.7",
+					"Via":             "1.0 edge",
+				},
 			},
 			{
-				name:   "only height",
-				width:  50,
-				height: 100,
-				imgUrl: "/img/success/100x100",
+				name:    "allowlist",
+				headers: config.HeadersConf{Allow: []string{"x-extra-header", "x-forwarded-for"}, ForwardedFor: true},
+				want: map[string]string{
+					TestHeader:        "test",
+					"Cookie":          "",
+					"Via":             "",
+					"X-Forwarded-For": "203.0.113.7, 192.0.2.1",
+				},
 			},
 			{
-				name:   "smaller than fill size",
-				width:  200,
-				height: 200,
-				imgUrl: "/img/success/100x100",
+				name:    "rename",
+				headers: config.HeadersConf{Rename: map[string]string{TestHeader: "X-Renamed"}},
+				want: map[string]string{
+					TestHeader:  "",
+					"X-Renamed": "test",
+				},
+			},
+			{
+				name: "inject",
+				headers: config.HeadersConf{
+					Deny:   []string{"Cookie"},
+					Inject: map[string]string{TestHeader: "injected", "Cookie": "origin=token"},
+				},
+				want: map[string]string{
+					TestHeader: "injected",
+					"Cookie":   "origin=token",
+				},
 			},
 		}
 
-		for _, tc := range tests {
-			tc := tc
-			t.Run(tc.name, func(t *testing.T) {
-				imgServer := createFakeImageServer()
-				defer imgServer.Close()
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				cfg := testPreviewerConf
+				cfg.Loader.Headers = tt.headers
+				server := createServerWithConfig(t, cfg)
 
-				imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, reqUrl, nil)
+				for name, value := range clientHeaders {
+					req.Header.Set(name, value)
+				}
+				server.Handler.ServeHTTP(rec, req)
 
-				reqUrl := path.Join(
-					"/fill",
-					strconv.Itoa(tc.width),
-					strconv.Itoa(tc.height),
-					imgServBaseUrl,
-					tc.imgUrl,
-				)
+				// the forwarded Accept-Encoding would leave the response compressed
+				require.Equal(t, http.StatusOK, rec.Code)
 
-				rec := httptest.NewRecorder()
-				req, _ := http.NewRequest(http.MethodGet, reqUrl, nil)
+				for name, value := range tt.want {
+					require.Equal(t, value, proxiedHeaders.Get(name), name)
+				}
+			})
+		}
+	})
 
-				createServer().Handler.ServeHTTP(rec, req)
+	t.Run("origin profiles", func(t *testing.T) {
+		imgServer := createFakeImageServer()
+		defer imgServer.Close()
 
-				require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+		port := imgServer.Listener.Addr().(*net.TCPAddr).Port
 
-				// check image height and width
-				img, _, err := image.Decode(rec.Body)
-				require.NoError(t, err)
+		cfg := testPreviewerConf
+		cfg.Profiles = []config.ProfileConf{
+			{
+				Name:    "limited",
+				Hosts:   []string{"127.0.0.*"},
+				Resizer: config.ResizerConf{MaxWidth: 40, MaxHeight: 40},
+				Encoder: config.EncoderConf{Quality: 10},
+			},
+		}
+		server := createServerWithConfig(t, cfg)
 
-				bounds := img.Bounds()
+		do := func(host string, size int) *httptest.ResponseRecorder {
+			reqUrl := fmt.Sprintf("/fill/%d/%d/%s:%d/img/success/100x100", size, size, host, port)
 
-				require.Equal(t, tc.width, bounds.Max.X)
-				require.Equal(t, tc.height, bounds.Max.Y)
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, reqUrl, nil)
+			server.Handler.ServeHTTP(rec, req)
 
-				// check image color in corners whith 5px padding
-				padding := 5
+			return rec
+		}
 
-				pixelColorTopLeft := color.Gray16Model.Convert(img.At(padding, padding))
-				require.Equal(t, pixelColorTopLeft, color.White)
+		rec := do("127.0.0.1", 50)
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+		require.Contains(t, rec.Body.String(), "dimensions_not_allowed")
 
-				pixelColorTopRight := color.Gray16Model.Convert(img.At(bounds.Max.X-padding, padding))
-				require.Equal(t, pixelColorTopRight, color.Black)
+		limited := do("127.0.0.1", 40)
+		require.Equal(t, http.StatusOK, limited.Code)
 
-				pixelColorBottomLeft := color.Gray16Model.Convert(img.At(padding, bounds.Max.Y-padding))
-				require.Equal(t, pixelColorBottomLeft, color.Black)
+		// the same origin under another name gets the default profile
+		fallback := do("localhost", 40)
+		require.Equal(t, http.StatusOK, fallback.Code)
+		require.Less(t, limited.Body.Len(), fallback.Body.Len())
 
-				pixelColorBottomRight := color.Gray16Model.Convert(img.At(bounds.Max.X-padding, bounds.Max.Y-padding))
-				require.Equal(t, pixelColorBottomRight, color.White)
-			})
-		}
+		require.Equal(t, http.StatusOK, do("localhost", 50).Code)
 	})
 
-	t.Run("remote error", func(t *testing.T) {
+	t.Run("origin aliases", func(t *testing.T) {
+		imgServer := createFakeImageServer()
+		defer imgServer.Close()
+
+		server := createServerWithConfigs(t, config.ServerConf{
+			Signature: config.SignatureConf{Unsafe: true},
+			Origins: config.OriginsConf{
+				Aliases: []config.AliasConf{
+					{
+						Name:    "catalog",
+						BaseURL: imgServer.URL + "/img/",
+						Rewrite: config.RewriteConf{From: "/products/", To: "/success/"},
+						Headers: map[string]string{TestHeader: "alias"},
+					},
+					{
+						Name:    "shop",
+						BaseURL: imgServer.URL,
+						Rewrite: config.RewriteConf{From: "/items", To: "/img/success"},
+						Headers: map[string]string{TestHeader: "alias"},
+					},
+				},
+			},
+		}, testPreviewerConf)
+
+		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+
 		tests := []struct {
-			name string
-			url  string
-			err  error
+			name       string
+			path       string
+			statusCode int
+			code       string
+			originPath string
 		}{
+			{name: "alias", path: "/fill/50/50/@catalog/success/100x100", statusCode: http.StatusOK},
+			{name: "rewritten path", path: "/fill/50/50/@catalog/products/100x100", statusCode: http.StatusOK},
+			{name: "rewritten prefix", path: "/fill/50/50/@shop/items/100x100", statusCode: http.StatusOK},
 			{
-				name: "not an image",
-				url:  "/img/not-an-image",
-				err:  app.ErrContentNotImage,
+				name:       "prefix ends at a slash",
+				path:       "/fill/50/50/@shop/itemsX/100x100",
+				statusCode: http.StatusNotFound,
+				code:       "image_not_found",
+				originPath: "/itemsX/100x100",
 			},
+			{name: "signed", path: "/fill/unsafe/50/50/@catalog/success/100x100", statusCode: http.StatusOK},
+			{name: "unknown alias", path: "/fill/50/50/@blog/success/100x100", statusCode: http.StatusBadRequest, code: "unknown_alias"},
+			{name: "alias with scheme", path: "/fill/https/50/50/@catalog/success/100x100", statusCode: http.StatusBadRequest, code: "bad_request"},
+			{name: "no path", path: "/fill/50/50/@catalog", statusCode: http.StatusBadRequest, code: "bad_request"},
 			{
-				name: "not found",
-				url:  "/img/error/404",
-				err:  app.ErrImageNotFound,
+				name:       "raw url disabled",
+				path:       path.Join("/fill/50/50", imgServBaseUrl, "/img/success/100x100"),
+				statusCode: http.StatusForbidden,
+				code:       "raw_url_disabled",
 			},
-			{
-				name: "bad request",
-				url:  "/img/error/400",
-				err:  app.ErrBadRequest,
-			},
-			{
-				name: "internal error",
-				url:  "/img/error/500",
-				err:  app.ErrInternal,
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest(http.MethodGet, tt.path, nil)
+				req.Header.Set(TestHeader, "client")
+				server.Handler.ServeHTTP(rec, req)
+
+				require.Equal(t, tt.statusCode, rec.Code)
+				if tt.originPath != "" {
+					require.Equal(t, tt.originPath, requestedPath)
+				}
+				if tt.code != "" {
+					require.Contains(t, rec.Body.String(), `"code":"`+tt.code+`"`)
+					return
+				}
+
+				// the header of the alias replaces the client one
+				require.Equal(t, "alias", headerValue)
+			})
+		}
+	})
+
+	t.Run("file origin", func(t *testing.T) {
+		root := t.TempDir()
+		require.NoError(t, os.Mkdir(path.Join(root, "catalog"), 0o755))
+
+		var img bytes.Buffer
+		require.NoError(t, jpeg.Encode(&img, createTestImage(100, 100), nil))
+		require.NoError(t, os.WriteFile(path.Join(root, "catalog", "img.jpg"), img.Bytes(), 0o600))
+
+		cfg := testPreviewerConf
+		cfg.Loader.File = config.FileConf{Root: root}
+
+		server := createServerWithConfigs(t, config.ServerConf{
+			Signature: config.SignatureConf{Unsafe: true},
+			Origins: config.OriginsConf{
+				Raw: true,
+				Aliases: []config.AliasConf{
+					{Name: "local", BaseURL: "file:///catalog"},
+					{Name: "media", BaseURL: "s3://bucket"},
+				},
 			},
+		}, cfg)
+
+		tests := []struct {
+			name       string
+			path       string
+			statusCode int
+		}{
+			{name: "alias", path: "/fill/50/50/@local/img.jpg", statusCode: http.StatusOK},
+			{name: "missing file", path: "/fill/50/50/@local/missing.jpg", statusCode: http.StatusNotFound},
+			{name: "unconfigured scheme", path: "/fill/50/50/@media/img.jpg", statusCode: http.StatusBadRequest},
+			// the raw urls would read any file under the root and any bucket of the credentials
+			{name: "raw file", path: "/fill/file/50/50/catalog/img.jpg", statusCode: http.StatusForbidden},
+			{name: "raw s3", path: "/fill/s3/50/50/bucket/img.jpg", statusCode: http.StatusForbidden},
 		}
 
-		var err error
-		stdout := path.Join(os.TempDir(), "/stdout")
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest(http.MethodGet, tt.path, nil)
+				server.Handler.ServeHTTP(rec, req)
 
-		os.Stdout, err = os.Create(stdout)
-		if err != nil {
-			log.Fatal(err)
+				require.Equal(t, tt.statusCode, rec.Code)
+			})
+		}
+	})
+
+	t.Run("dimensions and presets", func(t *testing.T) {
+		imgServer := createFakeImageServer()
+		defer imgServer.Close()
+
+		cfg := testPreviewerConf
+		cfg.Resizer = config.ResizerConf{
+			MinWidth:  10,
+			MinHeight: 10,
+			MaxWidth:  200,
+			MaxHeight: 200,
+			Presets:   []config.PresetConf{{Name: "card", Width: 40, Height: 30}},
+		}
+		server := createServerWithConfig(t, cfg)
+
+		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+		imgPath := "/img/success/100x100"
+
+		tests := []struct {
+			name       string
+			prefix     string
+			statusCode int
+			code       string
+			width      int
+			height     int
+		}{
+			{name: "preset", prefix: "/fill/preset:card", statusCode: http.StatusOK, width: 40, height: 30},
+			{name: "preset with options", prefix: "/fill/preset:card/q:50", statusCode: http.StatusOK, width: 40, height: 30},
+			{name: "negative", prefix: "/fill/-50/50", statusCode: http.StatusBadRequest, code: "invalid_dimensions"},
+			{name: "zero", prefix: "/fill/0/50", statusCode: http.StatusBadRequest, code: "invalid_dimensions"},
+			{name: "too small", prefix: "/fill/5/50", statusCode: http.StatusBadRequest, code: "dimensions_not_allowed"},
+			{name: "too large", prefix: "/fill/100000/100000", statusCode: http.StatusBadRequest, code: "dimensions_not_allowed"},
+			{name: "unknown preset", prefix: "/fill/preset:hero", statusCode: http.StatusBadRequest, code: "unknown_preset"},
+			{name: "preset with dimensions", prefix: "/fill/preset:card/50/50", statusCode: http.StatusBadRequest, code: "bad_request"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest(http.MethodGet, path.Join(tt.prefix, imgServBaseUrl, imgPath), nil)
+				server.Handler.ServeHTTP(rec, req)
+
+				require.Equal(t, tt.statusCode, rec.Code)
+				if tt.code != "" {
+					require.Contains(t, rec.Body.String(), `"code":"`+tt.code+`"`)
+					return
+				}
+
+				img, err := jpeg.Decode(rec.Body)
+				require.NoError(t, err)
+				require.Equal(t, tt.width, img.Bounds().Dx())
+				require.Equal(t, tt.height, img.Bounds().Dy())
+			})
 		}
 
+		t.Run("preset with port", func(t *testing.T) {
+			port := imgServer.Listener.Addr().(*net.TCPAddr).Port
+
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/fill/preset:card/127.0.0.1:%d%s", port, imgPath), nil)
+			server.Handler.ServeHTTP(rec, req)
+
+			require.Equal(t, http.StatusOK, rec.Code)
+		})
+	})
+
+	t.Run("cached image", func(t *testing.T) {
 		imgServer := createFakeImageServer()
 		defer imgServer.Close()
 
 		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
 
+		reqUrl := path.Join(
+			"/fill/50/50",
+			imgServBaseUrl,
+			"/img/success/100x100",
+		)
+
+		server := createServer(t)
+
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, reqUrl, nil)
+		server.Handler.ServeHTTP(rec, req)
+
+		require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+
+		// the origin is gone, the second response must be served from cache as is
+		imgServer.Close()
+
+		cachedRec := httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodGet, reqUrl, nil)
+		server.Handler.ServeHTTP(cachedRec, req)
+
+		require.Equal(t, http.StatusOK, cachedRec.Result().StatusCode)
+		require.Equal(t, "image/jpeg", cachedRec.Result().Header.Get("Content-Type"))
+		require.Equal(t, rec.Body.Bytes(), cachedRec.Body.Bytes())
+	})
+
+	t.Run("https origin", func(t *testing.T) {
+		imgServer := createFakeTLSImageServer()
+		defer imgServer.Close()
+
+		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "https://", "", 1))
+		caFile := writeCAFile(t, imgServer)
+
+		tests := []struct {
+			name   string
+			prefix string
+			loader config.LoaderConf
+			status int
+		}{
+			{
+				name:   "scheme in url",
+				prefix: "/fill/https/50/50",
+				loader: config.LoaderConf{DefaultScheme: "http", TLS: config.TLSConf{CAFile: caFile}},
+				status: http.StatusOK,
+			},
+			{
+				name:   "default scheme",
+				prefix: "/fill/50/50",
+				loader: config.LoaderConf{DefaultScheme: "https", TLS: config.TLSConf{CAFile: caFile}},
+				status: http.StatusOK,
+			},
+			{
+				name:   "untrusted certificate",
+				prefix: "/fill/https/50/50",
+				loader: config.LoaderConf{DefaultScheme: "http"},
+				status: http.StatusBadGateway,
+			},
+			{
+				name:   "insecure skip verify",
+				prefix: "/fill/https/50/50",
+				loader: config.LoaderConf{DefaultScheme: "http", TLS: config.TLSConf{InsecureSkipVerify: true}},
+				status: http.StatusOK,
+			},
+		}
+
 		for _, tc := range tests {
 			tc := tc
 			t.Run(tc.name, func(t *testing.T) {
 				reqUrl := path.Join(
-					"/fill/100/100",
+					tc.prefix,
 					imgServBaseUrl,
-					tc.url,
+					"/img/success/100x100",
 				)
 
 				rec := httptest.NewRecorder()
 				req, _ := http.NewRequest(http.MethodGet, reqUrl, nil)
 
-				createServer().Handler.ServeHTTP(rec, req)
+				createServerWithConfig(t, config.PreviewerConf{
+					RequestTimeout: time.Second,
+					CacheSize:      10,
+					Loader:         tc.loader,
+				}).Handler.ServeHTTP(rec, req)
+
+				require.Equal(t, tc.status, rec.Result().StatusCode)
+			})
+		}
+	})
+
+	t.Run("scheme fallback", func(t *testing.T) {
+		imgServer := createFakeImageServer()
+		defer imgServer.Close()
+
+		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+
+		reqUrl := path.Join(
+			"/fill/50/50",
+			imgServBaseUrl,
+			"/img/success/100x100",
+		)
+
+		// the origin accepts the connection and fails the handshake, it is never downgraded to http
+		for _, fallback := range []bool{false, true} {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, reqUrl, nil)
+
+			createServerWithConfig(t, config.PreviewerConf{
+				RequestTimeout: time.Second,
+				CacheSize:      10,
+				Loader:         config.LoaderConf{DefaultScheme: "https", SchemeFallback: fallback},
+			}).Handler.ServeHTTP(rec, req)
+
+			require.Equal(t, http.StatusBadGateway, rec.Result().StatusCode)
+		}
+	})
+
+	t.Run("forbidden host", func(t *testing.T) {
+		imgServer := createFakeImageServer()
+		defer imgServer.Close()
+
+		imgServHost := strings.Replace(imgServer.URL, "http://", "", 1)
+		imgServPort, err := strconv.Atoi(imgServHost[strings.LastIndex(imgServHost, ":")+1:])
+		require.NoError(t, err)
+
+		// redirects to the image server
+		redirectServer := httptest.NewServer(http.RedirectHandler(imgServer.URL+"/img/success/100x100", http.StatusFound))
+		defer redirectServer.Close()
+
+		redirectServHost := strings.Replace(redirectServer.URL, "http://", "", 1)
+		redirectServPort, err := strconv.Atoi(redirectServHost[strings.LastIndex(redirectServHost, ":")+1:])
+		require.NoError(t, err)
+
+		tests := []struct {
+			name   string
+			host   string
+			access config.AccessConf
+			status int
+		}{
+			{
+				name:   "denied network",
+				host:   imgServHost,
+				access: config.AccessConf{DenyCIDRs: config.DefaultDenyCIDRs},
+				status: http.StatusForbidden,
+			},
+			{
+				name:   "unspecified ipv6 address",
+				host:   "[::]:" + strconv.Itoa(imgServPort),
+				access: config.AccessConf{DenyCIDRs: config.DefaultDenyCIDRs},
+				status: http.StatusForbidden,
+			},
+			{
+				name:   "unspecified address not in deny list",
+				host:   "[::]:" + strconv.Itoa(imgServPort),
+				access: config.AccessConf{DenyPorts: []int{1}},
+				status: http.StatusForbidden,
+			},
+			{
+				name:   "loopback not in deny list",
+				host:   imgServHost,
+				access: config.AccessConf{DenyPorts: []int{1}},
+				status: http.StatusForbidden,
+			},
+			{
+				name:   "denied host name",
+				host:   "localhost:" + strconv.Itoa(imgServPort),
+				access: config.AccessConf{DenyHosts: []string{"localhost"}},
+				status: http.StatusForbidden,
+			},
+			{
+				name:   "resolved to denied network",
+				host:   "localhost:" + strconv.Itoa(imgServPort),
+				access: config.AccessConf{DenyCIDRs: []string{"127.0.0.0/8", "::1/128"}},
+				status: http.StatusForbidden,
+			},
+			{
+				name:   "not in allowed hosts",
+				host:   imgServHost,
+				access: config.AccessConf{AllowHosts: []string{"*.example.com"}},
+				status: http.StatusForbidden,
+			},
+			{
+				name:   "denied port",
+				host:   imgServHost,
+				access: config.AccessConf{DenyPorts: []int{imgServPort}},
+				status: http.StatusForbidden,
+			},
+			{
+				name:   "redirect to not allowed port",
+				host:   redirectServHost,
+				access: config.AccessConf{AllowPorts: []int{redirectServPort}},
+				status: http.StatusForbidden,
+			},
+			{
+				name:   "allowed",
+				host:   imgServHost,
+				access: config.AccessConf{AllowCIDRs: []string{"127.0.0.0/8"}, AllowPorts: []int{imgServPort}},
+				status: http.StatusOK,
+			},
+		}
+
+		for _, tc := range tests {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				reqUrl := path.Join(
+					"/fill/50/50",
+					url.QueryEscape(tc.host),
+					"/img/success/100x100",
+				)
+
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest(http.MethodGet, reqUrl, nil)
+
+				createServerWithConfig(t, config.PreviewerConf{
+					RequestTimeout: time.Second,
+					CacheSize:      10,
+					Loader:         config.LoaderConf{Access: tc.access},
+				}).Handler.ServeHTTP(rec, req)
+
+				require.Equal(t, tc.status, rec.Result().StatusCode)
+			})
+		}
+	})
+
+	t.Run("too large image", func(t *testing.T) {
+		imgServer := createFakeImageServer()
+		defer imgServer.Close()
+
+		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+
+		tests := []struct {
+			name   string
+			imgUrl string
+			loader config.LoaderConf
+			status int
+		}{
+			{
+				name:   "body size",
+				imgUrl: "/img/success/100x100",
+				loader: config.LoaderConf{MaxBodyBytes: 100},
+				status: http.StatusRequestEntityTooLarge,
+			},
+			{
+				name:   "pixel count",
+				imgUrl: "/img/success/100x100",
+				loader: config.LoaderConf{MaxSourcePixels: 100*100 - 1},
+				status: http.StatusUnprocessableEntity,
+			},
+			{
+				name:   "decompression bomb",
+				imgUrl: "/img/bomb",
+				loader: config.LoaderConf{MaxSourcePixels: 50_000_000},
+				status: http.StatusUnprocessableEntity,
+			},
+			{
+				name:   "within limits",
+				imgUrl: "/img/success/100x100",
+				loader: config.LoaderConf{MaxBodyBytes: 1 << 20, MaxSourcePixels: 100 * 100},
+				status: http.StatusOK,
+			},
+		}
+
+		for _, tc := range tests {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				reqUrl := path.Join(
+					"/fill/50/50",
+					imgServBaseUrl,
+					tc.imgUrl,
+				)
+
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest(http.MethodGet, reqUrl, nil)
+
+				createServerWithConfig(t, config.PreviewerConf{
+					RequestTimeout: time.Second,
+					CacheSize:      10,
+					Loader:         tc.loader,
+				}).Handler.ServeHTTP(rec, req)
+
+				require.Equal(t, tc.status, rec.Result().StatusCode)
+			})
+		}
+	})
+
+	t.Run("fill image", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			width  int
+			height int
+			imgUrl string
+		}{
+			{
+				name:   "simple",
+				width:  50,
+				height: 50,
+				imgUrl: "/img/success/100x100",
+			},
+			{
+				name:   "only width",
+				width:  50,
+				height: 100,
+				imgUrl: "/img/success/100x100",
+			},
+			{
+				name:   "only height",
+				width:  50,
+				height: 100,
+				imgUrl: "/img/success/100x100",
+			},
+			{
+				name:   "smaller than fill size",
+				width:  200,
+				height: 200,
+				imgUrl: "/img/success/100x100",
+			},
+		}
+
+		for _, tc := range tests {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				imgServer := createFakeImageServer()
+				defer imgServer.Close()
+
+				imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+
+				reqUrl := path.Join(
+					"/fill",
+					strconv.Itoa(tc.width),
+					strconv.Itoa(tc.height),
+					imgServBaseUrl,
+					tc.imgUrl,
+				)
+
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest(http.MethodGet, reqUrl, nil)
+
+				createServer(t).Handler.ServeHTTP(rec, req)
+
+				require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+
+				// check image height and width
+				img, _, err := image.Decode(rec.Body)
+				require.NoError(t, err)
+
+				bounds := img.Bounds()
+
+				require.Equal(t, tc.width, bounds.Max.X)
+				require.Equal(t, tc.height, bounds.Max.Y)
+
+				// check image color in corners whith 5px padding
+				padding := 5
+
+				pixelColorTopLeft := color.Gray16Model.Convert(img.At(padding, padding))
+				require.Equal(t, pixelColorTopLeft, color.White)
+
+				pixelColorTopRight := color.Gray16Model.Convert(img.At(bounds.Max.X-padding, padding))
+				require.Equal(t, pixelColorTopRight, color.Black)
+
+				pixelColorBottomLeft := color.Gray16Model.Convert(img.At(padding, bounds.Max.Y-padding))
+				require.Equal(t, pixelColorBottomLeft, color.Black)
+
+				pixelColorBottomRight := color.Gray16Model.Convert(img.At(bounds.Max.X-padding, bounds.Max.Y-padding))
+				require.Equal(t, pixelColorBottomRight, color.White)
+			})
+		}
+	})
+
+	t.Run("resize modes", func(t *testing.T) {
+		imgServer := createFakeImageServer()
+		defer imgServer.Close()
+
+		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+
+		red := color.NRGBA{R: 0xff, A: 0xff}
+
+		tests := []struct {
+			name   string
+			prefix string
+			width  int
+			height int
+			// pixel expected to be filled with the background
+			bgPixel *image.Point
+		}{
+			{name: "fit", prefix: "/fit/50/25", width: 25, height: 25},
+			{name: "fit width only", prefix: "/fit/50/0", width: 50, height: 50},
+			{name: "fit height only", prefix: "/fit/0/40", width: 40, height: 40},
+			{name: "pad", prefix: "/pad/bg:ff0000/50/25", width: 50, height: 25, bgPixel: &image.Point{X: 2, Y: 12}},
+			{name: "resize", prefix: "/resize/80/40", width: 80, height: 40},
+			{name: "resize width only", prefix: "/resize/50/0", width: 50, height: 50},
+			{name: "resize height only", prefix: "/resize/0/30", width: 30, height: 30},
+		}
+
+		// one server for all the cases, so the variants share the cache
+		server := createServer(t)
+
+		for _, tc := range tests {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				// the fill of the same size is cached first and must not be returned instead
+				fillRec := httptest.NewRecorder()
+				fillReq, _ := http.NewRequest(http.MethodGet, path.Join("/fill", strconv.Itoa(tc.width), strconv.Itoa(tc.height), imgServBaseUrl, "/img/success/100x100"), nil)
+				server.Handler.ServeHTTP(fillRec, fillReq)
+				require.Equal(t, http.StatusOK, fillRec.Result().StatusCode)
+
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest(http.MethodGet, path.Join(tc.prefix, imgServBaseUrl, "/img/success/100x100"), nil)
+				server.Handler.ServeHTTP(rec, req)
+
+				require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+
+				img, _, err := image.Decode(rec.Body)
+				require.NoError(t, err)
+
+				require.Equal(t, tc.width, img.Bounds().Dx())
+				require.Equal(t, tc.height, img.Bounds().Dy())
+
+				if tc.bgPixel != nil {
+					r, g, b, _ := img.At(tc.bgPixel.X, tc.bgPixel.Y).RGBA()
+					er, eg, eb, _ := red.RGBA()
+					require.InDelta(t, er>>8, r>>8, 8)
+					require.InDelta(t, eg>>8, g>>8, 8)
+					require.InDelta(t, eb>>8, b>>8, 8)
+				}
+			})
+		}
+	})
+
+	t.Run("output formats", func(t *testing.T) {
+		imgServer := createFakeImageServer()
+		defer imgServer.Close()
+
+		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+
+		tests := []struct {
+			name        string
+			prefix      string
+			accept      string
+			contentType string
+			vary        string
+		}{
+			{name: "default", prefix: "/fill/50/50", contentType: "image/jpeg", vary: "Accept"},
+			{name: "any image", prefix: "/fill/50/50", accept: "image/*,*/*;q=0.8", contentType: "image/jpeg", vary: "Accept"},
+			{name: "webp accepted", prefix: "/fill/50/50", accept: "image/webp,image/*,*/*;q=0.8", contentType: "image/jpeg", vary: "Accept"},
+			{name: "png preferred", prefix: "/fill/50/50", accept: "image/webp;q=0.5,image/png", contentType: "image/png", vary: "Accept"},
+			{name: "unsupported accepted", prefix: "/fill/50/50", accept: "image/avif", contentType: "image/jpeg", vary: "Accept"},
+			{name: "explicit format", prefix: "/fill/format:png/50/50", accept: "image/webp", contentType: "image/png"},
+			{name: "jpg alias", prefix: "/fill/format:jpg/50/50", accept: "image/webp", contentType: "image/jpeg"},
+		}
+
+		// one server for all the cases, so the formats share the cache
+		server := createServer(t)
+
+		for _, tc := range tests {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest(http.MethodGet, path.Join(tc.prefix, imgServBaseUrl, "/img/success/100x100"), nil)
+				req.Header.Set("Accept", tc.accept)
+				server.Handler.ServeHTTP(rec, req)
+
+				require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+				require.Equal(t, tc.contentType, rec.Result().Header.Get("Content-Type"))
+				require.Equal(t, tc.vary, rec.Result().Header.Get("Vary"))
+
+				img, format, err := image.Decode(rec.Body)
+				require.NoError(t, err)
+				require.Equal(t, "image/"+format, tc.contentType)
+				require.Equal(t, 50, img.Bounds().Dx())
+			})
+		}
+	})
+
+	t.Run("negotiated format size", func(t *testing.T) {
+		imgServer := createFakeImageServer()
+		defer imgServer.Close()
+
+		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+
+		// encoding the photo losslessly is slow under the race detector
+		cfg := testPreviewerConf
+		cfg.RequestTimeout = 10 * time.Second
+		server := createServerWithConfig(t, cfg)
+
+		do := func(prefix, accept string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, path.Join(prefix, imgServBaseUrl, "/img/photo"), nil)
+			req.Header.Set("Accept", accept)
+			server.Handler.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusOK, rec.Code)
+
+			return rec
+		}
+
+		jpegSize := do("/fill/format:jpeg/300/200", "").Body.Len()
+
+		// the lossless formats are many times larger for photos, the browsers must not get them
+		for _, accept := range []string{
+			"image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8",
+			"image/avif,image/webp,*/*",
+			"image/webp,image/avif,image/jxl,image/heic,image/heic-sequence,video/*;q=0.8,image/png,image/svg+xml,image/*;q=0.8,*/*;q=0.5",
+		} {
+			require.LessOrEqual(t, do("/fill/300/200", accept).Body.Len(), jpegSize, accept)
+		}
+	})
+
+	t.Run("quality", func(t *testing.T) {
+		imgServer := createFakeImageServer()
+		defer imgServer.Close()
+
+		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+
+		server := createServerWithConfig(t, config.PreviewerConf{
+			RequestTimeout: time.Second,
+			CacheSize:      10,
+			Encoder: config.EncoderConf{
+				Quality:         60,
+				MinQuality:      20,
+				MaxQuality:      80,
+				JPEGProgressive: true,
+			},
+		})
+
+		fetch := func(prefix string) []byte {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, path.Join(prefix, imgServBaseUrl, "/img/success/100x100"), nil)
+			server.Handler.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusOK, rec.Result().StatusCode, prefix)
+
+			return rec.Body.Bytes()
+		}
+
+		low, high := fetch("/fill/q:20/100/100"), fetch("/fill/q:80/100/100")
+		require.Less(t, len(low), len(high))
+
+		// progressive
+		require.True(t, bytes.Contains(high, []byte{0xff, 0xc2}))
+
+		require.Equal(t, fetch("/fill/q:60/100/100"), fetch("/fill/100/100"))
+		require.Equal(t, low, fetch("/fill/q:5/100/100"))
+		require.Equal(t, high, fetch("/fill/q:95/100/100"))
+	})
+
+	t.Run("signature", func(t *testing.T) {
+		imgServer := createFakeImageServer()
+		defer imgServer.Close()
+
+		// the paths are signed unescaped
+		imgServHost := strings.Replace(imgServer.URL, "http://", "", 1)
+		unsigned := path.Join("/fill/50/50", imgServHost, "/img/success/100x100")
+
+		oldKey, newKey := []byte("old secret"), []byte("new secret")
+
+		signPath := func(key []byte, path string) string {
+			signed, err := signature.SignPath(key, path)
+			require.NoError(t, err)
+
+			return signed
+		}
+
+		// the signature of another size
+		tampered := strings.Replace(signPath(newKey, unsigned), "/50/50/", "/50/51/", 1)
+
+		tests := []struct {
+			name       string
+			unsafe     bool
+			path       string
+			statusCode int
+		}{
+			{name: "signed", path: signPath(newKey, unsigned), statusCode: http.StatusOK},
+			{name: "signed with rotated key", path: signPath(oldKey, unsigned), statusCode: http.StatusOK},
+			{name: "signed with options", path: signPath(newKey, path.Join("/pad/http/bg:ff0000/50/50", imgServHost, "/img/success/100x100")), statusCode: http.StatusOK},
+			{name: "signed escaped path", path: signPath(newKey, path.Join("/fill/50/50", imgServHost, "/img/фото 1.jpg")), statusCode: http.StatusNotFound},
+			{name: "unknown key", path: signPath([]byte("other"), unsigned), statusCode: http.StatusForbidden},
+			{name: "tampered", path: tampered, statusCode: http.StatusForbidden},
+			{name: "unsigned", path: unsigned, statusCode: http.StatusForbidden},
+			{name: "unsafe segment", path: "/fill/unsafe/" + strings.TrimPrefix(unsigned, "/fill/"), statusCode: http.StatusForbidden},
+			{name: "unsafe mode unsigned", unsafe: true, path: unsigned, statusCode: http.StatusOK},
+			{name: "unsafe mode unsafe segment", unsafe: true, path: "/fill/unsafe/" + strings.TrimPrefix(unsigned, "/fill/"), statusCode: http.StatusOK},
+			{name: "unsafe mode tampered", unsafe: true, path: tampered, statusCode: http.StatusOK},
+		}
+
+		for _, tc := range tests {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				server := createServerWithConfigs(t, config.ServerConf{
+					Signature: config.SignatureConf{
+						Keys:   []string{string(newKey), string(oldKey)},
+						Unsafe: tc.unsafe,
+					},
+					Origins: config.OriginsConf{Raw: true},
+				}, testPreviewerConf)
+
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest(http.MethodGet, tc.path, nil)
+				server.Handler.ServeHTTP(rec, req)
+
+				require.Equal(t, tc.statusCode, rec.Result().StatusCode)
+				if tc.statusCode == http.StatusForbidden {
+					require.Contains(t, rec.Body.String(), `"code":"bad_signature"`)
+				}
+			})
+		}
+
+		t.Run("no keys", func(t *testing.T) {
+			server := createServerWithConfigs(t, config.ServerConf{
+				Origins: config.OriginsConf{Raw: true},
+			}, testPreviewerConf)
+
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, unsigned, nil)
+			server.Handler.ServeHTTP(rec, req)
+
+			require.Equal(t, http.StatusForbidden, rec.Result().StatusCode)
+		})
+	})
+
+	t.Run("http caching", func(t *testing.T) {
+		imgServer := createFakeImageServer()
+		defer imgServer.Close()
+
+		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+		reqUrl := path.Join("/fill/50/50", imgServBaseUrl, "/img/success/100x100")
+
+		server := createServerWithConfigs(t, config.ServerConf{
+			Signature: config.SignatureConf{Unsafe: true},
+			Origins:   config.OriginsConf{Raw: true},
+			HTTPCache: config.HTTPCacheConf{
+				MaxAge:     10 * time.Minute,
+				Directives: "public",
+			},
+		}, testPreviewerConf)
+
+		do := func(method, reqUrl string, headers map[string]string) *http.Response {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, reqUrl, nil)
+			for name, value := range headers {
+				req.Header.Set(name, value)
+			}
+			server.Handler.ServeHTTP(rec, req)
+
+			return rec.Result()
+		}
+
+		response := do(http.MethodGet, reqUrl, nil)
+		require.Equal(t, http.StatusOK, response.StatusCode)
+
+		etag, lastModified := response.Header.Get("ETag"), response.Header.Get("Last-Modified")
+		require.NotEmpty(t, etag)
+		require.NotEmpty(t, lastModified)
+		require.Equal(t, "max-age=600, public", response.Header.Get("Cache-Control"))
+
+		expires, err := http.ParseTime(response.Header.Get("Expires"))
+		require.NoError(t, err)
+		require.WithinDuration(t, time.Now().Add(10*time.Minute), expires, time.Minute)
+
+		// another variant has another validator
+		other := do(http.MethodGet, path.Join("/fill/60/60", imgServBaseUrl, "/img/success/100x100"), nil)
+		require.NotEqual(t, etag, other.Header.Get("ETag"))
+
+		tests := []struct {
+			name       string
+			method     string
+			headers    map[string]string
+			statusCode int
+		}{
+			{name: "matching etag", headers: map[string]string{"If-None-Match": etag}, statusCode: http.StatusNotModified},
+			{name: "weak etag", headers: map[string]string{"If-None-Match": `"other", W/` + etag}, statusCode: http.StatusNotModified},
+			{name: "any etag", headers: map[string]string{"If-None-Match": "*"}, statusCode: http.StatusNotModified},
+			{name: "other etag", headers: map[string]string{"If-None-Match": `"other"`}, statusCode: http.StatusOK},
+			{name: "not modified since", headers: map[string]string{"If-Modified-Since": lastModified}, statusCode: http.StatusNotModified},
+			{name: "modified since", headers: map[string]string{"If-Modified-Since": "Mon, 02 Jan 2006 15:04:05 GMT"}, statusCode: http.StatusOK},
+			{
+				name:       "etag takes precedence",
+				headers:    map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lastModified},
+				statusCode: http.StatusOK,
+			},
+			{name: "head", method: http.MethodHead, statusCode: http.StatusOK},
+		}
+
+		for _, tc := range tests {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				method := tc.method
+				if method == "" {
+					method = http.MethodGet
+				}
+
+				response := do(method, reqUrl, tc.headers)
+				require.Equal(t, tc.statusCode, response.StatusCode)
+				require.Equal(t, etag, response.Header.Get("ETag"))
+				require.Equal(t, "max-age=600, public", response.Header.Get("Cache-Control"))
+
+				body, err := ioutil.ReadAll(response.Body)
+				require.NoError(t, err)
+
+				if tc.statusCode == http.StatusOK && method == http.MethodGet {
+					require.NotEmpty(t, body)
+				}
+				if tc.statusCode == http.StatusNotModified {
+					require.Empty(t, body)
+				}
+			})
+		}
+	})
+
+	t.Run("response freshness", func(t *testing.T) {
+		imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", map[string]string{
+				"/img/long":    "max-age=7200",
+				"/img/minute":  "max-age=60",
+				"/img/stale":   "max-age=0",
+				"/img/private": "private, max-age=600",
+			}[r.URL.Path])
+			jpeg.Encode(w, createTestImage(100, 100), &jpeg.Options{Quality: 100})
+		}))
+		defer imgServer.Close()
+
+		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+		server := createServerWithConfigs(t, config.ServerConf{
+			Signature: config.SignatureConf{Unsafe: true},
+			Origins:   config.OriginsConf{Raw: true},
+			HTTPCache: config.HTTPCacheConf{
+				MaxAge:     time.Hour,
+				Directives: "public",
+			},
+		}, testPreviewerConf)
+
+		tests := []struct {
+			path         string
+			cacheControl string
+			expires      time.Duration
+		}{
+			{path: "/img/long", cacheControl: "^max-age=3600, public$", expires: time.Hour},
+			{path: "/img/minute", cacheControl: "^max-age=(59|60), public$", expires: time.Minute},
+			{path: "/img/stale", cacheControl: "^no-cache, public$"},
+			{path: "/img/private", cacheControl: "^no-store$"},
+		}
+
+		for _, tc := range tests {
+			tc := tc
+			t.Run(tc.path, func(t *testing.T) {
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest(http.MethodGet, path.Join("/fill/50/50", imgServBaseUrl, tc.path), nil)
+				server.Handler.ServeHTTP(rec, req)
+				require.Equal(t, http.StatusOK, rec.Code)
+				require.Regexp(t, tc.cacheControl, rec.Header().Get("Cache-Control"))
+
+				if rec.Header().Get("Cache-Control") == "no-store" {
+					require.Empty(t, rec.Header().Get("Expires"))
+					return
+				}
+
+				expires, err := http.ParseTime(rec.Header().Get("Expires"))
+				require.NoError(t, err)
+				require.WithinDuration(t, time.Now().Add(tc.expires), expires, 2*time.Second)
+			})
+		}
+	})
+
+	t.Run("origin revalidation", func(t *testing.T) {
+		var lock sync.Mutex
+		version, cacheControl := "v1", "max-age=0"
+		var full, notModified int
+		var ifNoneMatch string
+
+		imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			etag := `"` + version + `"`
+			ifNoneMatch = r.Header.Get("If-None-Match")
+
+			w.Header().Set("Cache-Control", cacheControl)
+			w.Header().Set("ETag", etag)
+
+			if ifNoneMatch == etag {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			full++
+			size := 100
+			if version != "v1" {
+				size = 60
+			}
+			jpeg.Encode(w, createTestImage(size, size), &jpeg.Options{Quality: 100})
+		}))
+		defer imgServer.Close()
+
+		setOrigin := func(v, cc string) {
+			lock.Lock()
+			defer lock.Unlock()
+			version, cacheControl = v, cc
+		}
+
+		counts := func() (int, int, string) {
+			lock.Lock()
+			defer lock.Unlock()
+			return full, notModified, ifNoneMatch
+		}
+
+		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+		server := createServer(t)
+
+		do := func(reqUrl string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, reqUrl, nil)
+			// the validators of the client are not meant for the origin
+			req.Header.Set("If-None-Match", `"client"`)
+			server.Handler.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusOK, rec.Code)
+
+			return rec
+		}
+
+		t.Run("expired entry revalidated", func(t *testing.T) {
+			reqUrl := path.Join("/fill/50/50", imgServBaseUrl, "/img/expired")
+
+			first := do(reqUrl)
+			require.Equal(t, "MISS", first.Header().Get("X-Cache-Status"))
+			fullCount, notModifiedCount, sent := counts()
+			require.Equal(t, 1, fullCount)
+			require.Equal(t, 0, notModifiedCount)
+			require.Empty(t, sent)
+
+			second := do(reqUrl)
+			require.Equal(t, "REVALIDATED", second.Header().Get("X-Cache-Status"))
+			fullCount, notModifiedCount, sent = counts()
+			require.Equal(t, 1, fullCount)
+			require.Equal(t, 1, notModifiedCount)
+			require.Equal(t, `"v1"`, sent)
+			require.Equal(t, first.Body.Bytes(), second.Body.Bytes())
+			require.Equal(t, first.Header().Get("ETag"), second.Header().Get("ETag"))
+
+			setOrigin("v2", "max-age=0")
+
+			third := do(reqUrl)
+			require.Equal(t, "MISS", third.Header().Get("X-Cache-Status"))
+			fullCount, notModifiedCount, sent = counts()
+			require.Equal(t, 2, fullCount)
+			require.Equal(t, 1, notModifiedCount)
+			require.Equal(t, `"v1"`, sent)
+			require.NotEqual(t, first.Header().Get("ETag"), third.Header().Get("ETag"))
+		})
+
+		t.Run("fresh entry served from cache", func(t *testing.T) {
+			setOrigin("v1", "public, max-age=3600")
+			reqUrl := path.Join("/fill/50/50", imgServBaseUrl, "/img/fresh")
+
+			fullBefore, notModifiedBefore, _ := counts()
+
+			require.Equal(t, "MISS", do(reqUrl).Header().Get("X-Cache-Status"))
+			require.Equal(t, "HIT", do(reqUrl).Header().Get("X-Cache-Status"))
+
+			fullCount, notModifiedCount, _ := counts()
+			require.Equal(t, fullBefore+1, fullCount)
+			require.Equal(t, notModifiedBefore, notModifiedCount)
+		})
+	})
+
+	t.Run("stale if error", func(t *testing.T) {
+		imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=0")
+			jpeg.Encode(w, createTestImage(100, 100), &jpeg.Options{Quality: 100})
+		}))
+
+		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+		reqUrl := path.Join("/fill/50/50", imgServBaseUrl, "/img/stale")
+
+		cfg := testPreviewerConf
+		cfg.Stale = config.StaleConf{IfError: time.Hour}
+		server := createServerWithConfig(t, cfg)
+
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, reqUrl, nil)
+		server.Handler.ServeHTTP(rec, req)
+
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "MISS", rec.Header().Get("X-Cache-Status"))
+
+		imgServer.Close()
+
+		staleRec := httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodGet, reqUrl, nil)
+		server.Handler.ServeHTTP(staleRec, req)
+
+		require.Equal(t, http.StatusOK, staleRec.Code)
+		require.Equal(t, "STALE", staleRec.Header().Get("X-Cache-Status"))
+		require.Equal(t, rec.Body.Bytes(), staleRec.Body.Bytes())
+	})
+
+	t.Run("negative caching", func(t *testing.T) {
+		var requests int32
+		imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer imgServer.Close()
+
+		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+		reqUrl := path.Join("/fill/50/50", imgServBaseUrl, "/img/missing")
+
+		cfg := testPreviewerConf
+		cfg.NegativeCache = config.NegativeCacheConf{TTL: time.Minute}
+		server := createServerWithConfigs(t, config.ServerConf{
+			Signature: config.SignatureConf{Unsafe: true},
+			Origins:   config.OriginsConf{Raw: true},
+			Admin:     config.AdminConf{Token: "secret"},
+		}, cfg)
+
+		do := func(method, reqUrl, token string) int {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, reqUrl, nil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			server.Handler.ServeHTTP(rec, req)
+
+			return rec.Code
+		}
+
+		require.Equal(t, http.StatusNotFound, do(http.MethodGet, reqUrl, ""))
+		require.Equal(t, http.StatusNotFound, do(http.MethodGet, reqUrl, ""))
+		require.EqualValues(t, 1, atomic.LoadInt32(&requests))
+
+		// the public preview url does not purge anything
+		require.Equal(t, http.StatusMethodNotAllowed, do(http.MethodDelete, reqUrl, "secret"))
+		require.Equal(t, http.StatusUnauthorized, do(http.MethodDelete, "/admin/failures"+reqUrl, ""))
+		require.Equal(t, http.StatusUnauthorized, do(http.MethodDelete, "/admin/failures"+reqUrl, "wrong"))
+		require.Equal(t, http.StatusNotFound, do(http.MethodGet, reqUrl, ""))
+		require.EqualValues(t, 1, atomic.LoadInt32(&requests))
+
+		require.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/admin/failures"+reqUrl, "secret"))
+
+		require.Equal(t, http.StatusNotFound, do(http.MethodGet, reqUrl, ""))
+		require.EqualValues(t, 2, atomic.LoadInt32(&requests))
+
+		t.Run("disabled without token", func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodDelete, "/admin/failures"+reqUrl, nil)
+			createServerWithConfig(t, cfg).Handler.ServeHTTP(rec, req)
+
+			require.Equal(t, http.StatusNotFound, rec.Code)
+		})
+	})
+
+	t.Run("client hang-up aborts origin fetch", func(t *testing.T) {
+		started, aborted := make(chan struct{}), make(chan struct{})
+
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+
+			select {
+			case <-r.Context().Done():
+				close(aborted)
+			case <-time.After(5 * time.Second):
+			}
+		}))
+		defer origin.Close()
+
+		// the origin fetch must be aborted by the client, not by the timeout
+		cfg := testPreviewerConf
+		cfg.RequestTimeout = 10 * time.Second
+
+		previewer := httptest.NewServer(createServerWithConfig(t, cfg).Handler)
+		defer previewer.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		originHost := url.QueryEscape(strings.TrimPrefix(origin.URL, "http://"))
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, previewer.URL+path.Join("/fill/50/50", originHost, "/img.jpg"), nil)
+		require.NoError(t, err)
+
+		errs := make(chan error, 1)
+		go func() {
+			response, err := http.DefaultClient.Do(req)
+			if err == nil {
+				response.Body.Close()
+			}
+			errs <- err
+		}()
+
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("the origin has not been requested")
+		}
+
+		cancel()
+		require.ErrorIs(t, <-errs, context.Canceled)
+
+		select {
+		case <-aborted:
+		case <-time.After(time.Second):
+			t.Fatal("the origin fetch has not been aborted")
+		}
+	})
+
+	t.Run("bad options", func(t *testing.T) {
+		for _, prefix := range []string{
+			"/fill/q:0/50/50",
+			"/fill/q:101/50/50",
+			"/fill/q:high/50/50",
+			"/fill/format:bmp/50/50",
+			"/fill/format:avif/50/50",
+			"/fill/format:webp/50/50",
+			"/pad/bg:red/50/50",
+			"/fill/bg:ff0000/50/50",
+			"/fill/unknown:1/50/50",
+			"/fill/something/50/50",
+		} {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, path.Join(prefix, "127.0.0.1", "/img/success/100x100"), nil)
+
+			createServer(t).Handler.ServeHTTP(rec, req)
+
+			require.Equal(t, http.StatusBadRequest, rec.Result().StatusCode, prefix)
+		}
+	})
+
+	t.Run("remote error", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			url        string
+			err        error
+			statusCode int
+			code       string
+		}{
+			{
+				name:       "not an image",
+				url:        "/img/not-an-image",
+				err:        app.ErrContentNotImage,
+				statusCode: http.StatusUnsupportedMediaType,
+				code:       "content_not_image",
+			},
+			{
+				name:       "corrupt image",
+				url:        "/img/corrupt",
+				err:        app.ErrCorruptImage,
+				statusCode: http.StatusUnprocessableEntity,
+				code:       "corrupt_image",
+			},
+			{
+				name:       "not found",
+				url:        "/img/error/404",
+				err:        app.ErrImageNotFound,
+				statusCode: http.StatusNotFound,
+				code:       "image_not_found",
+			},
+			{
+				name:       "bad request",
+				url:        "/img/error/400",
+				err:        app.ErrBadRequest,
+				statusCode: http.StatusBadGateway,
+				code:       "upstream_bad_request",
+			},
+			{
+				name:       "internal error",
+				url:        "/img/error/500",
+				err:        app.ErrInternal,
+				statusCode: http.StatusBadGateway,
+				code:       "upstream_error",
+			},
+			{
+				name:       "timeout",
+				url:        "/img/slow",
+				err:        app.ErrTimeout,
+				statusCode: http.StatusGatewayTimeout,
+				code:       "upstream_timeout",
+			},
+		}
+
+		var err error
+		stdout := path.Join(os.TempDir(), "/stdout")
+
+		os.Stdout, err = os.Create(stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		imgServer := createFakeImageServer()
+		defer imgServer.Close()
+
+		imgServBaseUrl := url.QueryEscape(strings.Replace(imgServer.URL, "http://", "", 1))
+
+		for _, tc := range tests {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				reqUrl := path.Join(
+					"/fill/100/100",
+					imgServBaseUrl,
+					tc.url,
+				)
+
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest(http.MethodGet, reqUrl, nil)
+
+				cfg := testPreviewerConf
+				cfg.RequestTimeout = 200 * time.Millisecond
+				createServerWithConfig(t, cfg).Handler.ServeHTTP(rec, req)
+
+				require.Equal(t, tc.statusCode, rec.Result().StatusCode)
+				require.Equal(t, "application/json", rec.Result().Header.Get("Content-Type"))
 
-				require.Equal(t, http.StatusBadGateway, rec.Result().StatusCode)
+				var body struct {
+					Code      string `json:"code"`
+					Message   string `json:"message"`
+					RequestID string `json:"request_id"`
+				}
+				require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+				require.Equal(t, tc.code, body.Code)
+				require.Equal(t, tc.err.Error(), body.Message)
+				require.NotEmpty(t, body.RequestID)
 
 				// check log message
 				logContent, err := ioutil.ReadFile(stdout)
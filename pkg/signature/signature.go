@@ -0,0 +1,82 @@
+// Package signature signs and verifies the previewer urls.
+//
+// The signature is the HMAC-SHA256 of the escaped url path without the leading slash and the signature segment,
+// e.g. "fill/300/200/example.com/img%201.jpg", encoded with the unpadded url safe base64.
+// It is put right after the mode: /fill/{signature}/300/200/example.com/img.jpg
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+var ErrBadPath = errors.New("path has no mode segment")
+
+var encoding = base64.RawURLEncoding
+
+// Length is the length of the encoded signature
+var Length = encoding.EncodedLen(sha256.Size)
+
+func Sign(key []byte, path string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(path))
+
+	return encoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignPath inserts the signature into the path and escapes it the way it is sent by the clients:
+// /fill/300/200/example.com/img 1.jpg becomes /fill/{signature}/300/200/example.com/img%201.jpg
+func SignPath(key []byte, path string) (string, error) {
+	escaped := (&url.URL{Path: path}).EscapedPath()
+
+	parts := strings.SplitN(strings.TrimPrefix(escaped, "/"), "/", 2)
+	if len(parts) < 2 || parts[0] == "" {
+		return "", ErrBadPath
+	}
+
+	return "/" + parts[0] + "/" + Sign(key, parts[0]+"/"+parts[1]) + "/" + parts[1], nil
+}
+
+// IsSignature reports whether the segment looks like a signature, it does not verify it
+func IsSignature(segment string) bool {
+	if len(segment) != Length {
+		return false
+	}
+
+	_, err := encoding.DecodeString(segment)
+
+	return err == nil
+}
+
+// Verifier accepts the signatures made with any of its keys, so the keys can be rotated
+type Verifier struct {
+	keys [][]byte
+}
+
+func NewVerifier(keys ...[]byte) *Verifier {
+	return &Verifier{
+		keys: keys,
+	}
+}
+
+func (v *Verifier) Verify(signature, path string) bool {
+	actual, err := encoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	for _, key := range v.keys {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(path))
+
+		if hmac.Equal(actual, mac.Sum(nil)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,62 @@
+package signature
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignPath(t *testing.T) {
+	key := []byte("secret")
+
+	signed, err := SignPath(key, "/fill/300/200/example.com/img.jpg")
+	require.NoError(t, err)
+
+	parts := strings.SplitN(signed, "/", 4)
+	require.Equal(t, "fill", parts[1])
+	require.True(t, IsSignature(parts[2]))
+	require.Equal(t, "300/200/example.com/img.jpg", parts[3])
+	require.Equal(t, Sign(key, "fill/300/200/example.com/img.jpg"), parts[2])
+
+	t.Run("escaped path", func(t *testing.T) {
+		signed, err := SignPath(key, "/fill/300/200/example.com/фото 1.jpg")
+		require.NoError(t, err)
+
+		parts := strings.SplitN(signed, "/", 4)
+		require.Equal(t, "300/200/example.com/%D1%84%D0%BE%D1%82%D0%BE%201.jpg", parts[3])
+
+		// the server verifies the path as it has been received
+		received, err := url.Parse(signed)
+		require.NoError(t, err)
+		require.Equal(t, signed, received.EscapedPath())
+		require.True(t, NewVerifier(key).Verify(parts[2], "fill/"+parts[3]))
+	})
+
+	for _, path := range []string{"", "/", "/fill"} {
+		_, err := SignPath(key, path)
+		require.ErrorIs(t, err, ErrBadPath, path)
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	oldKey, newKey := []byte("old"), []byte("new")
+	path := "fill/300/200/example.com/img.jpg"
+
+	verifier := NewVerifier(newKey, oldKey)
+
+	require.True(t, verifier.Verify(Sign(newKey, path), path))
+	require.True(t, verifier.Verify(Sign(oldKey, path), path))
+
+	require.False(t, verifier.Verify(Sign([]byte("other"), path), path))
+	require.False(t, verifier.Verify(Sign(newKey, path), "fill/3000/2000/example.com/img.jpg"))
+	require.False(t, verifier.Verify("unsafe", path))
+	require.False(t, NewVerifier().Verify(Sign(newKey, path), path))
+}
+
+func TestIsSignature(t *testing.T) {
+	require.True(t, IsSignature(Sign([]byte("key"), "path")))
+	require.False(t, IsSignature("unsafe"))
+	require.False(t, IsSignature(strings.Repeat("*", Length)))
+}